@@ -0,0 +1,124 @@
+package blurhash
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Encoder of BlurHash (https://blurha.sh): compact representation of an image placeholder
+
+const characters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// Encode makes hash of the image given as raw sRGB pixels, 3 bytes per pixel. Components count sets level of
+// details in each direction and must be between 1 and 9
+func Encode(xComponents int, yComponents int, width int, height int, rgb []byte) (string, error) {
+	if xComponents < 1 || xComponents > 9 || yComponents < 1 || yComponents > 9 {
+		return "", fmt.Errorf("components count must be in 1..9, got %dx%d", xComponents, yComponents)
+	}
+	if width < 1 || height < 1 {
+		return "", errors.New("empty image")
+	}
+	if len(rgb) < width*height*3 {
+		return "", fmt.Errorf("not enough pixels for %dx%d image", width, height)
+	}
+
+	factors := make([][3]float64, 0, xComponents*yComponents)
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			factors = append(factors, basisFactor(i, j, width, height, rgb))
+		}
+	}
+
+	var hash strings.Builder
+	hash.WriteString(encode83((xComponents-1)+(yComponents-1)*9, 1))
+
+	maximumValue := 1.0
+	if len(factors) > 1 {
+		actualMaximum := 0.0
+		for _, factor := range factors[1:] {
+			for _, v := range factor {
+				actualMaximum = math.Max(actualMaximum, math.Abs(v))
+			}
+		}
+		quantisedMaximum := int(math.Max(0, math.Min(82, math.Floor(actualMaximum*166-0.5))))
+		maximumValue = float64(quantisedMaximum+1) / 166
+		hash.WriteString(encode83(quantisedMaximum, 1))
+	} else {
+		hash.WriteString(encode83(0, 1))
+	}
+
+	hash.WriteString(encode83(encodeDC(factors[0]), 4))
+	for _, factor := range factors[1:] {
+		hash.WriteString(encode83(encodeAC(factor, maximumValue), 2))
+	}
+
+	return hash.String(), nil
+}
+
+func basisFactor(i int, j int, width int, height int, rgb []byte) [3]float64 {
+	var factor [3]float64
+
+	normalisation := 2.0
+	if i == 0 && j == 0 {
+		normalisation = 1
+	}
+
+	for y := 0; y < height; y++ {
+		basisY := math.Cos(math.Pi * float64(j) * float64(y) / float64(height))
+		for x := 0; x < width; x++ {
+			basis := normalisation * basisY * math.Cos(math.Pi*float64(i)*float64(x)/float64(width))
+			offset := (y*width + x) * 3
+			factor[0] += basis * sRGBToLinear(rgb[offset])
+			factor[1] += basis * sRGBToLinear(rgb[offset+1])
+			factor[2] += basis * sRGBToLinear(rgb[offset+2])
+		}
+	}
+
+	scale := 1 / float64(width*height)
+	for c := range factor {
+		factor[c] *= scale
+	}
+	return factor
+}
+
+func encodeDC(value [3]float64) int {
+	return linearToSRGB(value[0])<<16 + linearToSRGB(value[1])<<8 + linearToSRGB(value[2])
+}
+
+func encodeAC(value [3]float64, maximumValue float64) int {
+	quant := func(v float64) int {
+		return int(math.Max(0, math.Min(18, math.Floor(signPow(v/maximumValue, 0.5)*9+9.5))))
+	}
+	return quant(value[0])*19*19 + quant(value[1])*19 + quant(value[2])
+}
+
+func encode83(value int, length int) string {
+	var result strings.Builder
+	for i := 1; i <= length; i++ {
+		digit := (value / int(math.Pow(83, float64(length-i)))) % 83
+		result.WriteByte(characters[digit])
+	}
+	return result.String()
+}
+
+func sRGBToLinear(value byte) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(value float64, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exp), value)
+}
@@ -0,0 +1,47 @@
+package blurhash
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestEncode(t *testing.T) {
+
+	var tests = []struct {
+		x, y  int
+		pixel []byte
+		want  string
+	}{
+		{4, 3, []byte{0, 0, 0}, "L00000fQfQfQfQfQfQfQfQfQfQfQ"},
+		{1, 1, []byte{255, 0, 0}, "00TI:j"},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("test%v", i), func(t *testing.T) {
+			rgb := bytes.Repeat(tt.pixel, 8*6)
+			hash, err := Encode(tt.x, tt.y, 8, 6, rgb)
+			if err != nil {
+				t.Errorf("encoding failed with %v", err)
+			}
+			if hash != tt.want {
+				t.Errorf("got %s, want %s", hash, tt.want)
+			}
+		})
+	}
+
+	gradient := make([]byte, 8*6*3)
+	for i := range gradient {
+		gradient[i] = byte(i)
+	}
+	if hash, _ := Encode(5, 2, 8, 6, gradient); len(hash) != 4+2*5*2 {
+		t.Errorf("wrong hash length %d for %s", len(hash), hash)
+	}
+
+	if _, err := Encode(10, 3, 8, 6, make([]byte, 8*6*3)); err == nil {
+		t.Error("expected error for too many components")
+	}
+	if _, err := Encode(4, 3, 8, 6, make([]byte, 10)); err == nil {
+		t.Error("expected error for short pixels buffer")
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/levmv/imgserv/config"
+	"github.com/levmv/imgserv/params"
+	"github.com/levmv/imgserv/storage"
+)
+
+// checkConfig validates everything run needs from the config, but reports all problems instead of stopping at the
+// first one. Storage is really connected, so it's checked with the same credentials and network as the server
+func checkConfig(cfgPath string) []error {
+	conf, err := config.Parse(cfgPath)
+	if err != nil {
+		return []error{err}
+	}
+
+	var errs []error
+	fail := func(section string, err error) {
+		errs = append(errs, fmt.Errorf("%s: %w", section, err))
+	}
+
+	var presets map[string]params.Params
+	if conf.Resizer.Presets != nil {
+		if presets, err = params.ParsePresets(string(conf.Resizer.Presets)); err != nil {
+			fail("resizer.presets", err)
+		}
+	}
+	for _, rule := range conf.Storage.Upload {
+		for _, name := range rule.Presets {
+			if _, ok := presets[name]; !ok {
+				fail("storage.upload", fmt.Errorf("unknown preset %s for prefix %q", name, rule.Prefix))
+			}
+		}
+	}
+
+	if conf.Server.LogFile != "" {
+		file, err := os.OpenFile(conf.Server.LogFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+		if err != nil {
+			fail("server.log_file", err)
+		} else {
+			file.Close()
+		}
+	}
+
+	var paths []string
+	if conf.Sharer != nil {
+		_, sharerPaths, err := prepareSharer(conf.Sharer)
+		if err != nil {
+			fail("sharer", err)
+		}
+		paths = sharerPaths
+	}
+
+	ctx := context.Background()
+
+	st, err := storage.NewCached(conf.Storage)
+	if err != nil {
+		fail("storage", err)
+		return errs
+	}
+	if err := st.Check(ctx); err != nil {
+		fail("storage", err)
+	}
+
+	spoolDirs := []string{"tus"}
+	if conf.Async.Workers > 0 {
+		spoolDirs = append(spoolDirs, "jobs")
+	}
+	for _, dir := range spoolDirs {
+		if _, err := st.SpoolDir(dir); err != nil {
+			fail("storage", err)
+		}
+	}
+
+	for _, path := range paths {
+		exists, err := st.Exists(ctx, path)
+		if err != nil {
+			fail("sharer", fmt.Errorf("failed to check %s: %w", path, err))
+		} else if !exists {
+			fail("sharer", fmt.Errorf("%s not found in storage", path))
+		}
+	}
+
+	return errs
+}
@@ -6,8 +6,14 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
 )
 
+// ServerConf sets up listening and limits. ReloadSecret enables /reload for requests with X-Reload-Secret header
+// equal to it, without the secret config is reloaded by SIGHUP only
 type ServerConf struct {
 	BindTo             string `json:"bind_to"`
 	MaxClients         int    `json:"max_clients"`
@@ -15,15 +21,111 @@ type ServerConf struct {
 	FreeMemoryInterval int    `json:"free_memory_interval"`
 	LogFile            string `json:"log_file"`
 	MemoryLimit        int64  `json:"go_memory_limit"`
+	ProcessingTimeout  int    `json:"processing_timeout"`
+	ReloadSecret       string `json:"reload_secret"`
+
+	Resize PoolConf `json:"resize"`
+	Share  PoolConf `json:"share"`
+	Upload PoolConf `json:"upload"`
+}
+
+// PoolConf limits one kind of work: Concurrency requests are processed at once, and up to MaxQueue wait for their
+// turn no longer than MaxWait seconds. Others get 503. Zero MaxQueue or MaxWait means no limit. Resize pool
+// defaults to server concurrency, and its queue is also limited by MaxClients
+type PoolConf struct {
+	Concurrency int `json:"concurrency"`
+	MaxQueue    int `json:"max_queue"`
+	MaxWait     int `json:"max_wait"`
 }
 
 type StorageConf struct {
-	Credentials string `json:"credentials"`
-	Region      string `json:"region"`
-	Bucket      string `json:"bucket"`
-	CachePath   string `json:"cache_path"`
-	MaxWidth    int    `json:"max_width"`
-	MaxHeight   int    `json:"max_height"`
+	Credentials  string       `json:"credentials"`
+	Region       string       `json:"region"`
+	Bucket       string       `json:"bucket"`
+	CachePath    string       `json:"cache_path"`
+	MaxWidth     int          `json:"max_width"`
+	MaxHeight    int          `json:"max_height"`
+	KeyHash      string       `json:"key_hash"`
+	Upload       []UploadConf `json:"upload"`
+	OutputCache  string       `json:"output_cache"`
+	OutputPrefix string       `json:"output_prefix"`
+}
+
+// UploadConf describes processing of uploaded images with keys starting with Prefix. The longest matching prefix
+// wins. Images uploaded without key get the rule with empty prefix, as generated keys are random. Zero Quality means
+// default for the format, zero MaxWidth/MaxHeight are taken from StorageConf.
+// Format "original" keeps the input format. Animated GIF and WebP are saved as they are, metadata included: they are
+// refused if they don't fit into MaxWidth/MaxHeight or need rotation, single frame GIF is saved as PNG.
+// Images are rotated upright by EXIF orientation unless KeepOrientation is set. Presets are rendered into the output
+// cache right after upload
+type UploadConf struct {
+	Prefix          string       `json:"prefix"`
+	Format          OutputFormat `json:"format"`
+	Quality         int          `json:"quality"`
+	KeepMetadata    bool         `json:"keep_metadata"`
+	KeepOrientation bool         `json:"keep_orientation"`
+	MaxWidth        int          `json:"max_width"`
+	MaxHeight       int          `json:"max_height"`
+	Presets         []string     `json:"presets"`
+}
+
+// Key hash modes for uploads without explicit key. Empty value means random keys
+const (
+	KeyHashOriginal = "original"
+	KeyHashOutput   = "output"
+)
+
+// Output cache modes. Processed images are kept either in the local cache only or also in the bucket under
+// OutputPrefix, so other nodes could use them. Empty value disables the cache
+const (
+	OutputCacheLocal = "local"
+	OutputCacheS3    = "s3"
+)
+
+// LimitsConf protects from decompression bombs. Everything is checked by file header, before decoding pixels
+type LimitsConf struct {
+	MaxFileSize    int64    `json:"max_file_size"`
+	MaxPixels      int      `json:"max_pixels"`
+	MaxWidth       int      `json:"max_width"`
+	MaxHeight      int      `json:"max_height"`
+	AllowedFormats []string `json:"allowed_formats"`
+}
+
+// FetcherConf restricts downloading of images by /upload_url. Empty AllowedHosts means any host, but addresses
+// from private networks are refused unless AllowPrivate is set. Host matches itself and its subdomains
+type FetcherConf struct {
+	AllowedHosts []string `json:"allowed_hosts"`
+	AllowPrivate bool     `json:"allow_private"`
+	MaxSize      int64    `json:"max_size"`
+	MaxRedirects int      `json:"max_redirects"`
+	Timeout      int      `json:"timeout"`
+}
+
+// UploadFileConf lets /upload_file read files only inside AllowedDirs. The endpoint is disabled without them
+type UploadFileConf struct {
+	AllowedDirs       []string `json:"allowed_dirs"`
+	DeleteAfterUpload bool     `json:"delete_after_upload"`
+}
+
+// TusConf sets up resumable uploads. Unfinished uploads are removed after Expiration seconds of inactivity.
+// Upload size is limited by LimitsConf.MaxFileSize. No more than MaxUploads unfinished uploads with total length
+// of MaxSpoolSize bytes are accepted at once, zero means no limit
+type TusConf struct {
+	Expiration   int   `json:"expiration"`
+	MaxUploads   int   `json:"max_uploads"`
+	MaxSpoolSize int64 `json:"max_spool_size"`
+}
+
+// AsyncConf enables background processing of uploads by /upload?async=1 with Workers goroutines. Up to QueueSize
+// jobs wait for a worker, the rest are refused. Webhook gets job json when it's done or failed, signed by
+// WebhookSecret if it's set. Finished jobs are kept for Expiration seconds
+type AsyncConf struct {
+	Workers        int    `json:"workers"`
+	QueueSize      int    `json:"queue_size"`
+	Webhook        string `json:"webhook"`
+	WebhookSecret  string `json:"webhook_secret"`
+	WebhookTimeout int    `json:"webhook_timeout"`
+	Expiration     int    `json:"expiration"`
 }
 
 type OutputFormat string
@@ -31,6 +133,9 @@ type OutputFormat string
 const OutputTypeVary OutputFormat = "vary"
 const OutputTypeJpeg OutputFormat = "jpeg"
 const OutputTypeWebp OutputFormat = "webp"
+const OutputTypeAvif OutputFormat = "avif"
+const OutputTypePng OutputFormat = "png"
+const OutputTypeOriginal OutputFormat = "original"
 
 type ResizerConf struct {
 	SignatureMethod string          `json:"signature_method"`
@@ -39,19 +144,126 @@ type ResizerConf struct {
 	OutputType      OutputFormat    `json:"output_format"`
 	WebpQCorrection int             `json:"webp_q_correction"`
 	JpegQCorrection int             `json:"jpeg_q_correction"`
+	InfoGPS         bool            `json:"info_gps"`
 }
 
+// SharerConf sets up share cards. Font, FontFile and Logo are used by templates without their own. Template
+// "default" looks like the cards always did, unless it's redefined. Sizes are added to the built-in ones
+// (og, twitter, vk, telegram, instagram) or replace them. Urls are signed by HMAC with resizer.signature_secret
+// whatever resizer.signature_method is, the secret is mandatory unless AllowUnsigned is set. Rendered cards are kept
+// in the output cache if it's enabled.
+// Logos are named logo paths, one of them replaces the template logo by "logo" url param. Logos and background
+// images are loaded from storage on start, and then reloaded on SIGHUP and every ReloadInterval seconds if it's set
 type SharerConf struct {
-	Logo     string `json:"logo"`
-	Font     string `json:"font"`
-	FontFile string `json:"font_file"`
+	Logo           string                   `json:"logo"`
+	Logos          map[string]string        `json:"logos"`
+	ReloadInterval int                      `json:"reload_interval"`
+	Font           string                   `json:"font"`
+	FontFile       string                   `json:"font_file"`
+	Templates      map[string]ShareTemplate `json:"templates"`
+	Sizes          map[string]ShareSize     `json:"sizes"`
+	AllowUnsigned  bool                     `json:"allow_unsigned"`
+}
+
+// ShareSize is canvas size for a social network, it overrides template size
+type ShareSize struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// ShareTemplate describes layout of a share card. Width and Height are canvas size, the canvas is smaller if the
+// image is. All positions and sizes inside are fractions of the canvas size, so the layout fits any canvas.
+// Background is used for cards requested without image
+type ShareTemplate struct {
+	Width      int             `json:"width"`
+	Height     int             `json:"height"`
+	Quality    int             `json:"quality"`
+	Background ShareBackground `json:"background"`
+	Overlay    ShareOverlay    `json:"overlay"`
+	Text       ShareText       `json:"text"`
+	Subtitle   ShareText       `json:"subtitle"`
+	Logo       ShareLogo       `json:"logo"`
+}
+
+// Share background types
+const (
+	ShareBackgroundColor  = "color"
+	ShareBackgroundLinear = "linear"
+	ShareBackgroundRadial = "radial"
+	ShareBackgroundBlur   = "blur"
+)
+
+// ShareBackground is generated instead of image. Color fills with Colors[0], linear gradient goes from Colors[0]
+// to Colors[1] along Angle in degrees (0 is from left to right, 90 from top to bottom), radial goes from Colors[0] in
+// the center to Colors[1] in the corners. Blur enlarges Image from storage to the canvas and blurs it with Blur
+// sigma (20 by default)
+type ShareBackground struct {
+	Type   string   `json:"type"`
+	Colors []string `json:"colors"`
+	Angle  float64  `json:"angle"`
+	Image  string   `json:"image"`
+	Blur   float64  `json:"blur"`
+}
+
+// ShareOverlay covers background with Color ("#rrggbb"). With Gradient its opacity goes from Opacity at the top
+// to GradientOpacity at the bottom
+type ShareOverlay struct {
+	Color           string  `json:"color"`
+	Opacity         float64 `json:"opacity"`
+	Gradient        bool    `json:"gradient"`
+	GradientOpacity float64 `json:"gradient_opacity"`
+}
+
+// ShareBox is a rectangle in fractions of the canvas size
+type ShareBox struct {
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+// ShareText is placed into the box. Font size is picked to fit the box, or, with MaxLines, to fit that many lines
+// into it. Then the font shrinks down to MinScale of that size (0.5 by default) until the whole text fits. If it
+// still doesn't, the text is cut by words with ellipsis if Ellipsis is set, or just cut off.
+// Align is "left" (default), "center" or "right", left and right swap for RTL text. Empty Font, FontFile and Color
+// of subtitle are taken from the text
+type ShareText struct {
+	ShareBox
+	Font     string       `json:"font"`
+	FontFile string       `json:"font_file"`
+	Color    string       `json:"color"`
+	Align    string       `json:"align"`
+	MaxLines int          `json:"max_lines"`
+	MinScale float64      `json:"min_scale"`
+	Ellipsis bool         `json:"ellipsis"`
+	Shadow   *ShareShadow `json:"shadow"`
+}
+
+// ShareShadow is drawn under text, black with opacity 1 and blur 4 by default. Missing Opacity or Blur keeps the
+// default one. Opacity is from 0 (no shadow) to 1
+type ShareShadow struct {
+	Color   string   `json:"color"`
+	Opacity *float64 `json:"opacity"`
+	Blur    *float64 `json:"blur"`
+}
+
+// ShareLogo is placed at X, Y and scaled to Width, keeping its proportions. Zero Width keeps its own size relative
+// to the template canvas. Height is ignored
+type ShareLogo struct {
+	ShareBox
+	Path string `json:"path"`
 }
 
 type Config struct {
-	Server  ServerConf  `json:"server"`
-	Resizer ResizerConf `json:"resizer"`
-	Sharer  *SharerConf `json:"sharer"`
-	Storage StorageConf `json:"storage"`
+	Server     ServerConf     `json:"server"`
+	Resizer    ResizerConf    `json:"resizer"`
+	Sharer     *SharerConf    `json:"sharer"`
+	Storage    StorageConf    `json:"storage"`
+	Limits     LimitsConf     `json:"limits"`
+	Fetcher    FetcherConf    `json:"fetcher"`
+	UploadFile UploadFileConf `json:"upload_file"`
+	Tus        TusConf        `json:"tus"`
+	Async      AsyncConf      `json:"async"`
 }
 
 func Parse(configFile string) (*Config, error) {
@@ -62,12 +274,47 @@ func Parse(configFile string) (*Config, error) {
 			Concurrency:        2,
 			FreeMemoryInterval: 20,
 			MemoryLimit:        80 * 1024 * 1024,
+			ProcessingTimeout:  30,
+			Resize: PoolConf{
+				MaxWait: 10,
+			},
+			Share: PoolConf{
+				Concurrency: 1,
+				MaxQueue:    20,
+				MaxWait:     10,
+			},
+			Upload: PoolConf{
+				Concurrency: 1,
+				MaxQueue:    20,
+				MaxWait:     30,
+			},
 		},
 		Resizer: ResizerConf{
 			WebpQCorrection: -2,
 			JpegQCorrection: 0,
 			OutputType:      OutputTypeVary,
 		},
+		Limits: LimitsConf{
+			MaxFileSize:    50 * 1024 * 1024,
+			MaxPixels:      16000 * 16000,
+			AllowedFormats: []string{"jpeg", "png", "webp", "gif", "heif"},
+		},
+		Fetcher: FetcherConf{
+			MaxSize:      20 * 1024 * 1024,
+			MaxRedirects: 3,
+			Timeout:      15,
+		},
+		Storage: StorageConf{
+			OutputPrefix: "_out/",
+		},
+		Tus: TusConf{
+			Expiration: 24 * 60 * 60,
+		},
+		Async: AsyncConf{
+			QueueSize:      100,
+			WebhookTimeout: 10,
+			Expiration:     24 * 60 * 60,
+		},
 	}
 
 	path, _ := filepath.Abs(configFile)
@@ -77,31 +324,78 @@ func Parse(configFile string) (*Config, error) {
 		return nil, fmt.Errorf("failed to read config: %s (%w)", path, err)
 	}
 
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if text, err = yamlToJSON(text); err != nil {
+			return nil, fmt.Errorf("failed to parse config: %s (%w)", path, err)
+		}
+	}
+
+	var doc any
+	if err := json.Unmarshal(text, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %s (%w)", path, err)
+	}
+
+	var errs pathErrors
+	unknownKeys(doc, reflect.TypeOf(cfg), "", &errs)
+
 	if err := json.Unmarshal(text, &cfg); err != nil {
-		return nil, err
+		errs = append(errs, err)
+		return nil, errs.join()
+	}
+
+	if err := applyEnv(reflect.ValueOf(&cfg).Elem(), envPrefix); err != nil {
+		errs = append(errs, err)
+		return nil, errs.join()
 	}
 
 	if cfg.Storage.Credentials == "" {
 		cfg.Storage.Credentials = ".aws_credentials"
 	} else if _, err := os.Stat(cfg.Storage.Credentials); errors.Is(err, os.ErrNotExist) {
-		return nil, fmt.Errorf("aws credentials files doesn't exist (%s)", cfg.Storage.Credentials)
+		errs.add("storage.credentials", "aws credentials files doesn't exist (%s)", cfg.Storage.Credentials)
 	}
 
-	if cfg.Storage.Region == "" {
-		cfg.Storage.Region = "ru-central1"
+	if cfg.Server.Resize.Concurrency == 0 {
+		cfg.Server.Resize.Concurrency = cfg.Server.Concurrency
 	}
 
-	if cfg.Storage.Bucket == "" {
-		return nil, fmt.Errorf("storage.bucket must not be empty")
+	if cfg.Storage.Region == "" {
+		cfg.Storage.Region = "ru-central1"
 	}
 
 	if cfg.Server.LogFile != "" {
 		var err error
 		cfg.Server.LogFile, err = filepath.Abs(cfg.Server.LogFile)
 		if err != nil {
-			return nil, fmt.Errorf("failed to process log file path: %s (%w)", cfg.Server.LogFile, err)
+			errs.add("server.log_file", "failed to process log file path: %s (%v)", cfg.Server.LogFile, err)
+		}
+	}
+
+	// Directories are compared with already resolved file paths, so they have to be resolved the same way
+	for i, dir := range cfg.UploadFile.AllowedDirs {
+		path, err := filepath.Abs(dir)
+		if err == nil {
+			path, err = filepath.EvalSymlinks(path)
+		}
+		if err != nil {
+			errs.add(fmt.Sprintf("upload_file.allowed_dirs[%d]", i), "failed to process path: %s (%v)", dir, err)
 		}
+		cfg.UploadFile.AllowedDirs[i] = path
 	}
 
+	cfg.validate(&errs)
+
+	if len(errs) > 0 {
+		return nil, errs.join()
+	}
 	return &cfg, nil
 }
+
+// yamlToJSON converts yaml config to json, so it's parsed by the same json tags. Presets stay json for params
+func yamlToJSON(text []byte) ([]byte, error) {
+	var doc any
+	if err := yaml.Unmarshal(text, &doc); err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
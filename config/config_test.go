@@ -0,0 +1,117 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes config file with existing credentials file to a temp dir
+func writeConfig(t *testing.T, name string, text string) string {
+	dir := t.TempDir()
+	credentials := filepath.Join(dir, "credentials")
+	if err := os.WriteFile(credentials, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	text = strings.ReplaceAll(text, "CREDENTIALS", credentials)
+	if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParse(t *testing.T) {
+	path := writeConfig(t, "config.json", `{
+		"server": {"max_clients": 10, "share": {"concurrency": 2}},
+		"resizer": {"output_format": "webp", "presets": {"sq": {"width": 100, "unchecked": 1}}},
+		"storage": {"bucket": "images", "credentials": "CREDENTIALS"},
+		"sharer": {"templates": {"card": {"text": {"x": 0.1, "width": 0.8}}}, "allow_unsigned": true}
+	}`)
+
+	cfg, err := Parse(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Server.MaxClients != 10 || cfg.Server.Share.Concurrency != 2 || cfg.Resizer.OutputType != OutputTypeWebp {
+		t.Errorf("unexpected config %+v", cfg)
+	}
+	if cfg.Sharer.Templates["card"].Text.Width != 0.8 {
+		t.Errorf("embedded share box is not parsed: %+v", cfg.Sharer.Templates["card"])
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	path := writeConfig(t, "config.json", `{
+		"server": {"max_client": 10, "concurrency": 0, "upload": {"max_queue": -1}},
+		"resizer": {"output_fromat": "webp", "output_format": "gif", "webp_q_correction": 80},
+		"storage": {"bucket": "images", "credentials": "CREDENTIALS", "upload": [{"prefix": "a/", "qualty": 90}]},
+		"limits": {"allowed_formats": ["jpeg", "bmp"]},
+		"sharer": {"templates": {"card": {"text": {"colour": "#ffffff"}}}, "sizes": {"x": {"width": 100}}}
+	}`)
+
+	_, err := Parse(path)
+	if err == nil {
+		t.Fatal("no error")
+	}
+
+	want := []string{
+		"server.max_client: unknown key",
+		"resizer.output_fromat: unknown key",
+		"storage.upload[0].qualty: unknown key",
+		"sharer.templates.card.text.colour: unknown key",
+		"server.concurrency: must be positive, got 0",
+		"server.upload.max_queue: must not be negative, got -1",
+		"resizer.output_format: unknown format gif",
+		"resizer.webp_q_correction: must be from -50 to 50, got 80",
+		"limits.allowed_formats[1]: unknown format bmp",
+		"sharer.sizes.x.height: must be positive, got 0",
+		"resizer.signature_secret: needed to sign share urls, or set sharer.allow_unsigned",
+	}
+	for _, line := range want {
+		if !strings.Contains(err.Error(), line) {
+			t.Errorf("error %q is not reported in:\n%v", line, err)
+		}
+	}
+}
+
+func TestParseYamlAndEnv(t *testing.T) {
+	path := writeConfig(t, "config.yaml", `
+storage:
+  bucket: images
+  credentials: CREDENTIALS
+resizer:
+  presets:
+    sq: {width: 100}
+`)
+	secret := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secret, []byte("s3cret\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("IMGSERV_RESIZER_SIGNATURE_SECRET_FILE", secret)
+	t.Setenv("IMGSERV_LIMITS_ALLOWED_FORMATS", "jpeg, png")
+	t.Setenv("IMGSERV_SERVER_SHARE_MAX_QUEUE", "5")
+	t.Setenv("IMGSERV_SHARER_LOGO", "logo.png")
+
+	cfg, err := Parse(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Resizer.SignatureSecret != "s3cret" {
+		t.Errorf("secret from file: %q", cfg.Resizer.SignatureSecret)
+	}
+	if strings.Join(cfg.Limits.AllowedFormats, ",") != "jpeg,png" {
+		t.Errorf("allowed formats: %v", cfg.Limits.AllowedFormats)
+	}
+	if cfg.Server.Share.MaxQueue != 5 {
+		t.Errorf("share max queue: %d", cfg.Server.Share.MaxQueue)
+	}
+	if cfg.Sharer == nil || cfg.Sharer.Logo != "logo.png" {
+		t.Errorf("sharer is not created by env: %+v", cfg.Sharer)
+	}
+	if string(cfg.Resizer.Presets) != `{"sq":{"width":100}}` {
+		t.Errorf("presets: %s", cfg.Resizer.Presets)
+	}
+}
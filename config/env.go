@@ -0,0 +1,153 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Every config key could be overridden by environment variable named by its path: IMGSERV_ and json names joined
+// by "_" in upper case, e.g. IMGSERV_RESIZER_SIGNATURE_SECRET. Variable with _FILE suffix names a file with the value
+// instead, for secrets mounted by docker or kubernetes. Scalars are written as is, lists of strings are comma
+// separated, everything else (maps, lists of structs, presets) is json
+
+const envPrefix = "IMGSERV"
+
+var rawMessageType = reflect.TypeOf(json.RawMessage{})
+
+// applyEnv overrides fields of the struct v from environment. Optional sections are created only if some of their
+// keys are set
+func applyEnv(v reflect.Value, prefix string) error {
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		value := v.Field(i)
+
+		if field.Anonymous {
+			if err := applyEnv(value, prefix); err != nil {
+				return err
+			}
+			continue
+		}
+
+		tag, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if tag == "" || tag == "-" {
+			continue
+		}
+		name := prefix + "_" + strings.ToUpper(tag)
+
+		switch {
+		case field.Type.Kind() == reflect.Struct:
+			if err := applyEnv(value, name); err != nil {
+				return err
+			}
+			continue
+		case field.Type.Kind() == reflect.Pointer && field.Type.Elem().Kind() == reflect.Struct:
+			if !hasEnv(name + "_") {
+				continue
+			}
+			if value.IsNil() {
+				value.Set(reflect.New(field.Type.Elem()))
+			}
+			if err := applyEnv(value.Elem(), name); err != nil {
+				return err
+			}
+			continue
+		}
+
+		str, ok, err := lookupEnv(name)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err := setEnvValue(value, str); err != nil {
+			return fmt.Errorf("incorrect %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func hasEnv(prefix string) bool {
+	for _, env := range os.Environ() {
+		if strings.HasPrefix(env, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupEnv returns value of the variable or contents of the file named by its _FILE variant
+func lookupEnv(name string) (string, bool, error) {
+	value, ok := os.LookupEnv(name)
+	file, fromFile := os.LookupEnv(name + "_FILE")
+
+	if !fromFile {
+		return value, ok, nil
+	}
+	if ok {
+		return "", false, fmt.Errorf("both %s and %s_FILE are set", name, name)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to read %s_FILE: %w", name, err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), true, nil
+}
+
+func setEnvValue(v reflect.Value, str string) error {
+	if v.Type() == rawMessageType {
+		if !json.Valid([]byte(str)) {
+			return errors.New("invalid json")
+		}
+		v.SetBytes([]byte(str))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(str)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return err
+		}
+		if v.OverflowInt(n) {
+			return fmt.Errorf("%d is out of range", n)
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(str, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(str)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return json.Unmarshal([]byte(str), v.Addr().Interface())
+		}
+		list := reflect.MakeSlice(v.Type(), 0, 0)
+		for _, item := range strings.Split(str, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = reflect.Append(list, reflect.ValueOf(item).Convert(v.Type().Elem()))
+			}
+		}
+		v.Set(list)
+	default:
+		return json.Unmarshal([]byte(str), v.Addr().Interface())
+	}
+	return nil
+}
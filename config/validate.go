@@ -0,0 +1,221 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// pathErrors collects config problems with json paths of the values, so all of them are reported at once
+type pathErrors []error
+
+func (errs *pathErrors) add(path string, format string, args ...any) {
+	*errs = append(*errs, fmt.Errorf("%s: %s", path, fmt.Sprintf(format, args...)))
+}
+
+func (errs pathErrors) join() error {
+	return errors.Join(errs...)
+}
+
+// Quality corrections are added to the requested quality, so they are limited to keep it meaningful
+const maxQCorrection = 50
+
+// Formats vips.FindLoader could return: nicknames of buffer loaders without "load_buffer", like "jpegload_buffer"
+var inputFormats = []string{"jpeg", "png", "webp", "gif", "heif", "tiff", "svg", "pdf", "jp2k", "jxl", "magick", "rad",
+	"ppm"}
+
+func (cfg *Config) validate(errs *pathErrors) {
+	server := cfg.Server
+	positive(errs, "server.max_clients", server.MaxClients)
+	positive(errs, "server.concurrency", server.Concurrency)
+	positive(errs, "server.free_memory_interval", server.FreeMemoryInterval)
+	notNegative(errs, "server.go_memory_limit", server.MemoryLimit)
+	notNegative(errs, "server.processing_timeout", server.ProcessingTimeout)
+	for name, pool := range map[string]PoolConf{"resize": server.Resize, "share": server.Share, "upload": server.Upload} {
+		positive(errs, "server."+name+".concurrency", pool.Concurrency)
+		notNegative(errs, "server."+name+".max_queue", pool.MaxQueue)
+		notNegative(errs, "server."+name+".max_wait", pool.MaxWait)
+	}
+
+	resizer := cfg.Resizer
+	switch resizer.SignatureMethod {
+	case "", "st3":
+	case "t3":
+		if resizer.SignatureSecret == "" {
+			errs.add("resizer.signature_secret", "t3 signature needs secret")
+		}
+	default:
+		errs.add("resizer.signature_method", "unknown method %s", resizer.SignatureMethod)
+	}
+	switch resizer.OutputType {
+	case OutputTypeVary, OutputTypeJpeg, OutputTypeWebp:
+	default:
+		errs.add("resizer.output_format", "unknown format %s", resizer.OutputType)
+	}
+	inRange(errs, "resizer.webp_q_correction", resizer.WebpQCorrection, -maxQCorrection, maxQCorrection)
+	inRange(errs, "resizer.jpeg_q_correction", resizer.JpegQCorrection, -maxQCorrection, maxQCorrection)
+
+	storage := cfg.Storage
+	if storage.Bucket == "" {
+		errs.add("storage.bucket", "must not be empty")
+	}
+	notNegative(errs, "storage.max_width", storage.MaxWidth)
+	notNegative(errs, "storage.max_height", storage.MaxHeight)
+	switch storage.KeyHash {
+	case "", KeyHashOriginal, KeyHashOutput:
+	default:
+		errs.add("storage.key_hash", "unknown mode %s", storage.KeyHash)
+	}
+	switch storage.OutputCache {
+	case "", OutputCacheLocal, OutputCacheS3:
+	default:
+		errs.add("storage.output_cache", "unknown mode %s", storage.OutputCache)
+	}
+	for i, rule := range storage.Upload {
+		path := fmt.Sprintf("storage.upload[%d]", i)
+		switch rule.Format {
+		case "", OutputTypeJpeg, OutputTypeWebp, OutputTypeAvif, OutputTypePng, OutputTypeOriginal:
+		default:
+			errs.add(path+".format", "unknown format %s", rule.Format)
+		}
+		inRange(errs, path+".quality", rule.Quality, 0, 100)
+		notNegative(errs, path+".max_width", rule.MaxWidth)
+		notNegative(errs, path+".max_height", rule.MaxHeight)
+		if len(rule.Presets) > 0 && storage.OutputCache == "" {
+			errs.add(path+".presets", "need storage.output_cache")
+		}
+	}
+
+	limits := cfg.Limits
+	notNegative(errs, "limits.max_file_size", limits.MaxFileSize)
+	notNegative(errs, "limits.max_pixels", limits.MaxPixels)
+	notNegative(errs, "limits.max_width", limits.MaxWidth)
+	notNegative(errs, "limits.max_height", limits.MaxHeight)
+	for i, format := range limits.AllowedFormats {
+		if !slices.Contains(inputFormats, format) {
+			errs.add(fmt.Sprintf("limits.allowed_formats[%d]", i), "unknown format %s", format)
+		}
+	}
+
+	notNegative(errs, "fetcher.max_size", cfg.Fetcher.MaxSize)
+	notNegative(errs, "fetcher.max_redirects", cfg.Fetcher.MaxRedirects)
+	notNegative(errs, "fetcher.timeout", cfg.Fetcher.Timeout)
+
+	notNegative(errs, "tus.expiration", cfg.Tus.Expiration)
+	notNegative(errs, "tus.max_uploads", cfg.Tus.MaxUploads)
+	notNegative(errs, "tus.max_spool_size", cfg.Tus.MaxSpoolSize)
+
+	async := cfg.Async
+	notNegative(errs, "async.workers", async.Workers)
+	if async.Workers > 0 {
+		positive(errs, "async.queue_size", async.QueueSize)
+		positive(errs, "async.webhook_timeout", async.WebhookTimeout)
+	}
+	notNegative(errs, "async.expiration", async.Expiration)
+
+	if sharer := cfg.Sharer; sharer != nil {
+		notNegative(errs, "sharer.reload_interval", sharer.ReloadInterval)
+		if !sharer.AllowUnsigned && cfg.Resizer.SignatureSecret == "" {
+			errs.add("resizer.signature_secret", "needed to sign share urls, or set sharer.allow_unsigned")
+		}
+		for name, size := range sharer.Sizes {
+			positive(errs, "sharer.sizes."+name+".width", size.Width)
+			positive(errs, "sharer.sizes."+name+".height", size.Height)
+		}
+	}
+}
+
+func positive[T int | int64](errs *pathErrors, path string, value T) {
+	if value <= 0 {
+		errs.add(path, "must be positive, got %d", value)
+	}
+}
+
+func notNegative[T int | int64](errs *pathErrors, path string, value T) {
+	if value < 0 {
+		errs.add(path, "must not be negative, got %d", value)
+	}
+}
+
+func inRange(errs *pathErrors, path string, value int, low int, high int) {
+	if value < low || value > high {
+		errs.add(path, "must be from %d to %d, got %d", low, high, value)
+	}
+}
+
+// unknownKeys reports keys of the json document which don't match any field of t. Presets are left to params
+func unknownKeys(doc any, t reflect.Type, path string, errs *pathErrors) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == rawMessageType {
+		return
+	}
+
+	// Values of wrong types are reported by json.Unmarshal
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, _ := doc.(map[string]any)
+		for _, key := range sortedKeys(obj) {
+			field, ok := jsonField(t, key)
+			if !ok {
+				errs.add(joinPath(path, key), "unknown key")
+				continue
+			}
+			unknownKeys(obj[key], field.Type, joinPath(path, key), errs)
+		}
+	case reflect.Map:
+		obj, _ := doc.(map[string]any)
+		for _, key := range sortedKeys(obj) {
+			unknownKeys(obj[key], t.Elem(), joinPath(path, key), errs)
+		}
+	case reflect.Slice:
+		list, _ := doc.([]any)
+		for i, value := range list {
+			unknownKeys(value, t.Elem(), fmt.Sprintf("%s[%d]", path, i), errs)
+		}
+	}
+}
+
+// jsonField finds struct field by json key, including fields of embedded structs. Keys are matched
+// case-insensitively, as encoding/json does
+func jsonField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous {
+			if embedded, ok := jsonField(field.Type, key); ok {
+				return embedded, true
+			}
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if strings.EqualFold(name, key) {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func sortedKeys(obj map[string]any) []string {
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/levmv/imgserv/config"
+)
+
+var (
+	errFetchForbidden = errors.New("fetching is not allowed")
+	errFetchFailed    = errors.New("fetching failed")
+)
+
+var fetcher struct {
+	client *http.Client
+	conf   config.FetcherConf
+}
+
+// nonPublicNets are special purpose ranges net.IP methods don't cover
+var nonPublicNets = parseCIDRs(
+	"0.0.0.0/8",     // "this network", 0.0.0.0 itself is treated as localhost by linux
+	"100.64.0.0/10", // shared address space (carrier-grade NAT)
+	"198.18.0.0/15", // benchmarking, sometimes used for internal networks
+	"240.0.0.0/4",   // reserved and broadcast
+	"64:ff9b::/96",  // NAT64, would reach any IPv4 address including private ones
+	"64:ff9b:1::/48",
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = ipNet
+	}
+	return nets
+}
+
+func initFetcher(conf config.FetcherConf) {
+	timeout := time.Duration(conf.Timeout) * time.Second
+
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		// Control gets already resolved address, so it also protects from DNS rebinding
+		Control: func(network, address string, c syscall.RawConn) error {
+			if conf.AllowPrivate {
+				return nil
+			}
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+				return fmt.Errorf("%w: private address %s", errFetchForbidden, host)
+			}
+			return nil
+		},
+	}
+
+	fetcher.conf = conf
+	fetcher.client = &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: timeout,
+			MaxIdleConns:        10,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > conf.MaxRedirects {
+				return fmt.Errorf("%w: stopped after %d redirects", errFetchFailed, conf.MaxRedirects)
+			}
+			return checkFetchURL(req.URL)
+		},
+	}
+}
+
+// isPublicIP checks address fetcher may connect to. IPv4-mapped IPv6 addresses are checked as IPv4 ones
+func isPublicIP(ip net.IP) bool {
+	if ip.IsPrivate() || ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsMulticast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	for _, ipNet := range nonPublicNets {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func checkFetchURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%w: scheme %s", errFetchForbidden, u.Scheme)
+	}
+
+	if len(fetcher.conf.AllowedHosts) == 0 {
+		return nil
+	}
+
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range fetcher.conf.AllowedHosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || strings.HasSuffix(host, "."+allowed) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: host %s", errFetchForbidden, host)
+}
+
+// fetchImage downloads whole file into memory, no more than fetcher.max_size. Time is limited by fetcher.timeout
+func fetchImage(ctx context.Context, rawURL string) ([]byte, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errFetchForbidden, err)
+	}
+	if err := checkFetchURL(u); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := fetcher.client.Do(req)
+	if err != nil {
+		if errors.Is(err, errFetchForbidden) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %v", errFetchFailed, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s responded with %s", errFetchFailed, rawURL, resp.Status)
+	}
+
+	maxSize := fetcher.conf.MaxSize
+	if maxSize > 0 && resp.ContentLength > maxSize {
+		return nil, fmt.Errorf("%w: %d bytes", errInputTooLarge, resp.ContentLength)
+	}
+
+	var buf bytes.Buffer
+	r := io.Reader(resp.Body)
+	if maxSize > 0 {
+		r = io.LimitReader(resp.Body, maxSize+1)
+	}
+	if _, err := buf.ReadFrom(r); err != nil {
+		return nil, fmt.Errorf("%w: %v", errFetchFailed, err)
+	}
+	if maxSize > 0 && int64(buf.Len()) > maxSize {
+		return nil, fmt.Errorf("%w: more than %d bytes", errInputTooLarge, maxSize)
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/levmv/imgserv/config"
+)
+
+func TestIsPublicIP(t *testing.T) {
+	var tests = []struct {
+		ip     string
+		public bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"0.1.2.3", false},
+		{"198.18.0.1", false},
+		{"198.19.255.255", false},
+		{"198.20.0.1", true},
+		{"255.255.255.255", false},
+		{"224.0.0.1", false},
+		{"::1", false},
+		{"::", false},
+		{"fc00::1", false},
+		{"fe80::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+		{"::ffff:169.254.169.254", false},
+		{"::ffff:93.184.216.34", true},
+		{"64:ff9b::a00:1", false},
+		{"64:ff9b::7f00:1", false},
+		{"64:ff9b:1::1", false},
+	}
+
+	for _, tt := range tests {
+		ip := net.ParseIP(tt.ip)
+		if ip == nil {
+			t.Fatalf("can't parse %s", tt.ip)
+		}
+		if got := isPublicIP(ip); got != tt.public {
+			t.Errorf("%s: got %v, want %v", tt.ip, got, tt.public)
+		}
+	}
+}
+
+func TestCheckFetchURL(t *testing.T) {
+	fetcher.conf = config.FetcherConf{AllowedHosts: []string{"example.com", "Img.Example.org"}}
+	defer func() { fetcher.conf = config.FetcherConf{} }()
+
+	var tests = []struct {
+		url     string
+		allowed bool
+	}{
+		{"https://example.com/a.jpg", true},
+		{"http://cdn.example.com/a.jpg", true},
+		{"https://EXAMPLE.COM/a.jpg", true},
+		{"https://example.com:8443/a.jpg", true},
+		{"https://img.example.org/a.jpg", true},
+		{"https://evilexample.com/a.jpg", false},
+		{"https://example.com.evil.com/a.jpg", false},
+		{"https://example.com@evil.com/a.jpg", false},
+		{"https://evil.com/example.com/a.jpg", false},
+		{"https://evil.com/?u=https://example.com", false},
+		{"https://example.org/a.jpg", false},
+		{"ftp://example.com/a.jpg", false},
+		{"file:///etc/passwd", false},
+	}
+
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = checkFetchURL(u)
+		if (err == nil) != tt.allowed {
+			t.Errorf("%s: got %v", tt.url, err)
+		}
+		if err != nil && !errors.Is(err, errFetchForbidden) {
+			t.Errorf("%s: unexpected error %v", tt.url, err)
+		}
+	}
+}
@@ -2,8 +2,12 @@ package main
 
 import (
 	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"runtime"
 	"strconv"
@@ -32,28 +36,54 @@ func serveImg(w http.ResponseWriter, r *http.Request) (int, error) {
 		return 400, errors.New("no input query")
 	}
 
-	verifiedQuery, err := sign.Verify(inputQuery)
+	st := current.Load()
+
+	verifiedQuery, err := st.sign.Verify(inputQuery)
 	if err != nil {
 		return 403, err
 	}
 
 	ctx := r.Context()
 
-	path, pms, err := params.Parse(verifiedQuery)
+	path, pms, err := st.presets.Parse(verifiedQuery)
 	if err != nil {
 		return 500, err
 	}
 
+	format := outputFormat(w, r, &st.conf.Resizer)
+	quality := exportQuality(pms, format, &st.conf.Resizer)
+
+	var key string
+	if imgStorage.OutputCache() {
+		version, err := imgStorage.Version(ctx, path)
+		if errors.Is(err, storage.NotFoundError) {
+			return 404, fmt.Errorf("%v %s", err, path)
+		}
+		if err != nil {
+			log.Printf("failed to get version of %s, output cache skipped: %v", path, err)
+		} else {
+			key = outputKey(path, version, pms, format, quality)
+			cached, err := imgStorage.LoadOutput(ctx, key)
+			defer cached.Close()
+			if err == nil {
+				return writeImage(w, format, cached.Data)
+			}
+			if !errors.Is(err, storage.NotCached) {
+				log.Printf("failed to load cached output %s: %v", key, err)
+			}
+		}
+	}
+
 	// We're limiting concurrency both for loading file and processing image. Even though it seems logical to separate
 	// io/cpu parts (and it was in first ver), it's more memory efficient that way and have no real performance impact
 	// in real (ours) production conditions
-	if err := queueSem.Acquire(ctx, 1); err != nil {
-		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
-			return 499, errors.New("request cancelled")
-		}
-		panic("queueSem")
+	if err := resizePool.acquire(ctx); err != nil {
+		return resizePool.reject(w, err)
 	}
-	defer queueSem.Release(1)
+	defer resizePool.release()
+
+	ctx, cancel := processingContext(ctx)
+	defer cancel()
 
 	sourceImg, err := imgStorage.LoadImage(ctx, path)
 	defer sourceImg.Close()
@@ -61,7 +91,11 @@ func serveImg(w http.ResponseWriter, r *http.Request) (int, error) {
 		if errors.Is(err, storage.NotFoundError) {
 			return 404, fmt.Errorf("%v %s", err, path)
 		}
-		return 500, err
+		return processingError(ctx, err)
+	}
+
+	if err := checkInput(sourceImg.Data); err != nil {
+		return processingError(ctx, fmt.Errorf("%s: %w", path, err))
 	}
 
 	runtime.LockOSThread()
@@ -71,10 +105,94 @@ func serveImg(w http.ResponseWriter, r *http.Request) (int, error) {
 	image := vips.Image{}
 	defer image.Close()
 
-	if err = image.LoadFromBuffer(sourceImg.Data); err != nil {
-		return 500, fmt.Errorf("failed to load %s: %v", verifiedQuery, err)
+	imageBytes, err := resizeImage(ctx, &image, sourceImg.Data, pms, format, quality)
+	if err != nil {
+		return processingError(ctx, fmt.Errorf("%s: %w", verifiedQuery, err))
+	}
+
+	if key != "" {
+		if err := imgStorage.SaveOutput(key, imageBytes); err != nil {
+			log.Printf("failed to save output %s: %v", key, err)
+		}
+	}
+
+	return writeImage(w, format, imageBytes)
+}
+
+// outputFormat chooses format of resized image. For "vary" it depends on Accept header
+func outputFormat(w http.ResponseWriter, r *http.Request, resizer *config.ResizerConf) config.OutputFormat {
+	switch resizer.OutputType {
+	case config.OutputTypeVary:
+		w.Header().Set("Vary", "Accept")
+		if strings.Contains(r.Header.Get("Accept"), "webp") {
+			return config.OutputTypeWebp
+		}
+		return config.OutputTypeJpeg
+	case config.OutputTypeWebp:
+		return config.OutputTypeWebp
+	}
+	return config.OutputTypeJpeg
+}
+
+// outputFormats lists all formats outputFormat could choose
+func outputFormats(resizer *config.ResizerConf) []config.OutputFormat {
+	switch resizer.OutputType {
+	case config.OutputTypeVary:
+		return []config.OutputFormat{config.OutputTypeJpeg, config.OutputTypeWebp}
+	case config.OutputTypeWebp:
+		return []config.OutputFormat{config.OutputTypeWebp}
+	}
+	return []config.OutputFormat{config.OutputTypeJpeg}
+}
+
+// exportQuality is the quality image is saved with: params one corrected by resizer settings for the format
+func exportQuality(pms params.Params, format config.OutputFormat, resizer *config.ResizerConf) int {
+	if format == config.OutputTypeWebp {
+		return pms.Quality + resizer.WebpQCorrection
+	}
+	return pms.Quality + resizer.JpegQCorrection
+}
+
+// outputKey names processed image in the output cache. It depends on parsed params rather than the query, so
+// preset and the same params written explicitly share one cached image. Version of the source and export quality
+// are a part of the key, so nothing made from deleted or replaced image, or with old settings, is served
+func outputKey(path string, version string, pms params.Params, format config.OutputFormat, quality int) string {
+	js, _ := json.Marshal(pms)
+	hash := md5.Sum(append([]byte(version+"\n"+strconv.Itoa(quality)+"\n"), js...))
+	return path + "/" + hex.EncodeToString(hash[:8]) + "." + string(format)
+}
+
+func writeImage(w http.ResponseWriter, format config.OutputFormat, data []byte) (int, error) {
+	w.Header().Set("Content-Type", "image/"+string(format))
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	_, err := w.Write(data)
+
+	return 200, err
+}
+
+// resizeImage loads image from data into given image, processes it by pms and exports with quality. Returned bytes
+// belong to the image, so they are valid until it's closed. Caller should lock OS thread and call vips.Cleanup
+func resizeImage(ctx context.Context, image *vips.Image, data []byte, pms params.Params, format config.OutputFormat,
+	quality int) ([]byte, error) {
+	canceler := vips.NewCanceler(ctx)
+	defer canceler.Close()
+
+	if err := image.LoadFromBuffer(data); err != nil {
+		return nil, fmt.Errorf("failed to load: %w", err)
+	}
+	canceler.Attach(image)
+
+	if err := checkDimensions(image); err != nil {
+		return nil, err
 	}
 
+	// Crop coordinates and sizes are given for upright image. ThumbnailFromBuffer rotates by itself, but we
+	// need the same dimensions for all checks below
+	if err := autoRotate(image, data); err != nil {
+		return nil, err
+	}
+	canceler.Attach(image)
+
 	size := vips.SizeDown
 
 	if pms.Crop.Width != 0 {
@@ -84,8 +202,8 @@ func serveImg(w http.ResponseWriter, r *http.Request) (int, error) {
 		if pms.Crop.Y+pms.Crop.Height > image.Height() {
 			pms.Crop.Height = image.Height() - pms.Crop.Y
 		}
-		if err = image.Crop(pms.Crop.X, pms.Crop.Y, pms.Crop.Width, pms.Crop.Height); err != nil {
-			return 500, err
+		if err := image.Crop(pms.Crop.X, pms.Crop.Y, pms.Crop.Width, pms.Crop.Height); err != nil {
+			return nil, err
 		}
 	}
 
@@ -121,15 +239,14 @@ func serveImg(w http.ResponseWriter, r *http.Request) (int, error) {
 		}
 
 		if pms.Crop.Width > 0 {
-			err = image.Thumbnail(pms.Width, pms.Height, params.Gravity2Vips(pms.Gravity), size)
-			if err != nil {
-				return 500, err
+			if err := image.Thumbnail(pms.Width, pms.Height, params.Gravity2Vips(pms.Gravity), size); err != nil {
+				return nil, err
 			}
 		} else {
-			err = image.ThumbnailFromBuffer(sourceImg.Data, pms.Width, height, params.Gravity2Vips(pms.Gravity), size)
-			if err != nil {
-				return 500, err
+			if err := image.ThumbnailFromBuffer(data, pms.Width, height, params.Gravity2Vips(pms.Gravity), size); err != nil {
+				return nil, err
 			}
+			canceler.Attach(image)
 		}
 
 		if pms.Mode == params.ModeFill {
@@ -141,7 +258,7 @@ func serveImg(w http.ResponseWriter, r *http.Request) (int, error) {
 				finalHeight,
 				vips.Color{R: 255, G: 255, B: 255},
 			); err != nil {
-				return 500, err
+				return nil, err
 			}
 		}
 
@@ -150,50 +267,37 @@ func serveImg(w http.ResponseWriter, r *http.Request) (int, error) {
 			for i, wm := range pms.Watermarks {
 				wmImg, err := imgStorage.LoadImage(ctx, wm.Path)
 				if err != nil {
-					return 500, fmt.Errorf("loading watermark %v", err)
+					return nil, fmt.Errorf("loading watermark %v", err)
 				}
 				wms = append(wms, &wmImg)
 				defer wms[i].Close()
 
-				if err := addWatermark(&image, wms[i], wm, pms.PixelRatio); err != nil {
-					return 500, fmt.Errorf("error during watermark %v", wm)
+				if err := addWatermark(image, wms[i], wm, pms.PixelRatio); err != nil {
+					return nil, fmt.Errorf("error during watermark %v: %w", wm, err)
 				}
 			}
 		}
 	}
 
-	var imageBytes []byte
+	canceler.Attach(image)
 
-	exportWebp := func() ([]byte, error) {
-		w.Header().Set("Content-Type", "image/webp")
-		return image.ExportWebp(pms.Quality + cfg.Resizer.WebpQCorrection)
-	}
-	exportJpeg := func() ([]byte, error) {
-		w.Header().Set("Content-Type", "image/jpeg")
-		return image.ExportJpeg(pms.Quality + cfg.Resizer.JpegQCorrection)
+	// Watermarks are read lazily, so export has to happen before their buffers are released
+	if format == config.OutputTypeWebp {
+		return image.ExportWebp(quality)
 	}
+	return image.ExportJpeg(quality)
+}
 
-	if cfg.Resizer.OutputType == config.OutputTypeVary {
-		w.Header().Set("Vary", "Accept")
-		if strings.Contains(r.Header.Get("Accept"), "webp") {
-			imageBytes, err = exportWebp()
-		} else {
-			imageBytes, err = exportJpeg()
-		}
-	} else if cfg.Resizer.OutputType == config.OutputTypeWebp {
-		imageBytes, err = exportWebp()
-	} else {
-		imageBytes, err = exportJpeg()
+// autoRotate turns image upright according to EXIF orientation. Must be called right after loading: rotation reads
+// pixels out of order, so the image is reloaded with random access when it actually needs rotating
+func autoRotate(image *vips.Image, data []byte) error {
+	if image.Orientation() <= 1 {
+		return nil
 	}
-
-	if err != nil {
-		return 500, err
+	if err := image.LoadFromBufferRandom(data); err != nil {
+		return err
 	}
-
-	w.Header().Set("Content-Length", strconv.Itoa(len(imageBytes)))
-	_, err = w.Write(imageBytes)
-
-	return 200, err
+	return image.AutoRotate()
 }
 
 func addWatermark(image *vips.Image, wmImg *storage.SourceImage, wm params.Watermark, pixelRatio float64) error {
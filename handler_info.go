@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/levmv/imgserv/storage"
+	"github.com/levmv/imgserv/vips"
+)
+
+type ImageInfo struct {
+	Width       int               `json:"width"`
+	Height      int               `json:"height"`
+	Format      string            `json:"format"`
+	Size        int               `json:"size"`
+	Bands       int               `json:"bands"`
+	ColorSpace  string            `json:"color_space"`
+	IccProfile  string            `json:"icc_profile,omitempty"`
+	Orientation int               `json:"orientation"`
+	Pages       int               `json:"pages"`
+	Animated    bool              `json:"animated"`
+	Exif        map[string]string `json:"exif,omitempty"`
+}
+
+// InfoHandler describes stored image. Only the header is read, no pixels are decoded
+func InfoHandler(w http.ResponseWriter, r *http.Request) (int, error) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		return 400, errors.New("empty key arg")
+	}
+
+	sourceImg, err := imgStorage.LoadImage(r.Context(), key)
+	defer sourceImg.Close()
+	if err != nil {
+		if errors.Is(err, storage.NotFoundError) {
+			return 404, fmt.Errorf("%v %s", err, key)
+		}
+		return 500, err
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	info, err := imageInfo(sourceImg.Data, current.Load().conf.Resizer.InfoGPS)
+	if err != nil {
+		return 500, fmt.Errorf("failed to load %s: %v", key, err)
+	}
+
+	js, _ := json.Marshal(info)
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(js)
+
+	return 200, nil
+}
+
+// imageInfo describes image by its header, no pixels are decoded
+func imageInfo(data []byte, withGPS bool) (ImageInfo, error) {
+	image := vips.Image{}
+	defer image.Close()
+	defer vips.Cleanup()
+
+	if err := image.LoadFromBuffer(data); err != nil {
+		return ImageInfo{}, err
+	}
+
+	format, _ := vips.FindLoader(data)
+
+	info := ImageInfo{
+		Width:       image.Width(),
+		Height:      image.Height(),
+		Format:      format,
+		Size:        len(data),
+		Bands:       image.Bands(),
+		ColorSpace:  image.Interpretation(),
+		Orientation: image.Orientation(),
+		Pages:       image.Pages(),
+		Exif:        exifFields(&image, withGPS),
+	}
+	info.Animated = info.Pages > 1 && (format == "gif" || format == "webp")
+
+	if profile, ok := image.GetBlob("icc-profile-data"); ok {
+		info.IccProfile = iccDescription(profile)
+	}
+
+	return info, nil
+}
+
+// exifFields collects exif fields of the main image by their names without vips prefixes. Vips formats values
+// like "Canon (Canon, ASCII, 6 components, 6 bytes)", so only the first part is kept
+func exifFields(image *vips.Image, withGPS bool) map[string]string {
+	fields := make(map[string]string)
+
+	for _, field := range image.Fields() {
+		name, ok := strings.CutPrefix(field, "exif-ifd")
+		if !ok {
+			continue
+		}
+		ifd, name, ok := strings.Cut(name, "-")
+		// ifd1 describes embedded thumbnail, and maker notes are binary garbage
+		if !ok || ifd == "1" || name == "MakerNote" {
+			continue
+		}
+		if !withGPS && strings.HasPrefix(name, "GPS") {
+			continue
+		}
+
+		value, ok := image.GetString(field)
+		if !ok {
+			continue
+		}
+		if i := strings.LastIndex(value, " ("); i >= 0 {
+			value = value[:i]
+		}
+		fields[name] = value
+	}
+
+	if len(fields) == 0 {
+		return nil
+	}
+	return fields
+}
+
+// iccDescription reads profile name from the 'desc' tag: ASCII in ICC v2 profiles, UTF-16 in v4 ones
+func iccDescription(profile []byte) string {
+	if len(profile) < 132 {
+		return ""
+	}
+
+	count := int(binary.BigEndian.Uint32(profile[128:]))
+	for i := 0; i < count; i++ {
+		entry := 132 + i*12
+		if entry+12 > len(profile) {
+			return ""
+		}
+		if string(profile[entry:entry+4]) != "desc" {
+			continue
+		}
+
+		offset := int(binary.BigEndian.Uint32(profile[entry+4:]))
+		size := int(binary.BigEndian.Uint32(profile[entry+8:]))
+		if offset < 0 || size < 12 || offset+size > len(profile) {
+			return ""
+		}
+		tag := profile[offset : offset+size]
+
+		switch string(tag[:4]) {
+		case "desc":
+			length := int(binary.BigEndian.Uint32(tag[8:]))
+			if length > len(tag)-12 {
+				return ""
+			}
+			return strings.TrimRight(string(tag[12:12+length]), "\x00")
+		case "mluc":
+			if len(tag) < 28 {
+				return ""
+			}
+			length := int(binary.BigEndian.Uint32(tag[20:]))
+			start := int(binary.BigEndian.Uint32(tag[24:]))
+			if start+length > len(tag) {
+				return ""
+			}
+			text := make([]uint16, length/2)
+			for j := range text {
+				text[j] = binary.BigEndian.Uint16(tag[start+j*2:])
+			}
+			return string(utf16.Decode(text))
+		}
+		return ""
+	}
+
+	return ""
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestImageInfo(t *testing.T) {
+	var tests = []struct {
+		file     string
+		format   string
+		pages    int
+		animated bool
+	}{
+		{"two-frames.gif", "gif", 2, true},
+		{"pixel.png", "png", 1, false},
+	}
+
+	for _, tt := range tests {
+		data, err := os.ReadFile("testdata/" + tt.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := imageInfo(data, false)
+		if err != nil {
+			t.Errorf("%s: %v", tt.file, err)
+			continue
+		}
+		if info.Format != tt.format || info.Pages != tt.pages || info.Animated != tt.animated {
+			t.Errorf("%s: got format %s, %d pages, animated %v", tt.file, info.Format, info.Pages, info.Animated)
+		}
+		if info.Width != 1 || info.Height != 1 {
+			t.Errorf("%s: got %dx%d", tt.file, info.Width, info.Height)
+		}
+	}
+}
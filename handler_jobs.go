@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/levmv/imgserv/config"
+)
+
+// Asynchronous uploads. Body is spooled to a file and the request returns job id at once, then one of the workers
+// processes it with the usual uploadPhoto. Job state is kept in a json file next to the body, so queued jobs survive
+// restart, and its status is available by /upload_status until expiration
+
+type jobStatus string
+
+const (
+	jobQueued     jobStatus = "queued"
+	jobProcessing jobStatus = "processing"
+	jobDone       jobStatus = "done"
+	jobFailed     jobStatus = "failed"
+)
+
+type uploadJob struct {
+	ID      string        `json:"id"`
+	Status  jobStatus     `json:"status"`
+	Key     string        `json:"key,omitempty"`
+	Presets []string      `json:"presets,omitempty"`
+	Error   string        `json:"error,omitempty"`
+	Result  *UploadedInfo `json:"result,omitempty"`
+}
+
+var jobs struct {
+	conf     config.AsyncConf
+	dir      string
+	queue    chan string
+	webhooks chan *uploadJob
+	client   *http.Client
+	mu       sync.Mutex // guards job files
+}
+
+const webhookAttempts = 3
+
+// initJobs starts workers. Webhooks are delivered by their own goroutines until ctx is done, so slow receiver
+// doesn't hold up processing
+func initJobs(ctx context.Context, conf config.AsyncConf) error {
+	if conf.Workers <= 0 {
+		return nil
+	}
+
+	var err error
+	jobs.dir, err = imgStorage.SpoolDir("jobs")
+	if err != nil {
+		return err
+	}
+	jobs.conf = conf
+	jobs.queue = make(chan string, conf.QueueSize)
+	jobs.client = &http.Client{Timeout: time.Duration(conf.WebhookTimeout) * time.Second}
+
+	pending, err := pendingJobs()
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < conf.Workers; i++ {
+		go jobWorker()
+	}
+
+	if conf.Webhook != "" {
+		jobs.webhooks = make(chan *uploadJob, conf.QueueSize)
+		for i := 0; i < conf.Workers; i++ {
+			go webhookSender(ctx)
+		}
+	}
+
+	// Jobs left from previous run may not fit into the queue, so they are pushed without holding up the start
+	go func() {
+		for _, id := range pending {
+			jobs.queue <- id
+		}
+	}()
+
+	if conf.Expiration > 0 {
+		go func() {
+			ticker := time.NewTicker(time.Hour)
+			defer ticker.Stop()
+			for range ticker.C {
+				removeExpiredJobs()
+			}
+		}()
+	}
+	return nil
+}
+
+func asyncEnabled() bool {
+	return jobs.queue != nil
+}
+
+// enqueueUpload spools body and puts the job into the queue. Queue overflow is reported before reading the body
+func enqueueUpload(w http.ResponseWriter, r *http.Request, key string, presets []string) (int, error) {
+	if !asyncEnabled() {
+		return 400, errors.New("async uploads are disabled")
+	}
+	if len(jobs.queue) >= cap(jobs.queue) {
+		w.Header().Set("Retry-After", "60")
+		return 503, errors.New("upload queue is full")
+	}
+
+	id, err := genUuid()
+	if err != nil {
+		return 500, err
+	}
+
+	path := filepath.Join(jobs.dir, id)
+	file, err := os.Create(path)
+	if err != nil {
+		return 500, err
+	}
+	written, err := io.Copy(file, limitInput(r.Body))
+	file.Close()
+	if maxSize := current.Load().conf.Limits.MaxFileSize; err == nil && maxSize > 0 && written > maxSize {
+		err = fmt.Errorf("%w: more than %d bytes", errInputTooLarge, maxSize)
+	}
+	if err != nil {
+		_ = os.Remove(path)
+		return processingError(r.Context(), err)
+	}
+
+	job := uploadJob{
+		ID:      id,
+		Status:  jobQueued,
+		Key:     key,
+		Presets: presets,
+	}
+	if err := writeJob(&job); err != nil {
+		_ = os.Remove(path)
+		return 500, err
+	}
+
+	select {
+	case jobs.queue <- id:
+	default:
+		removeJob(id)
+		w.Header().Set("Retry-After", "60")
+		return 503, errors.New("upload queue is full")
+	}
+
+	js, _ := json.Marshal(job)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_, _ = w.Write(js)
+
+	return 202, nil
+}
+
+func UploadStatusHandler(w http.ResponseWriter, r *http.Request) (int, error) {
+	if !asyncEnabled() {
+		return 404, errors.New("async uploads are disabled")
+	}
+
+	id := r.URL.Query().Get("id")
+	if !isUuid(id) {
+		return 404, fmt.Errorf("incorrect job id %s", id)
+	}
+
+	job, err := readJob(id)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 404, fmt.Errorf("job not found %s", id)
+		}
+		return 500, err
+	}
+
+	js, _ := json.Marshal(job)
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(js)
+
+	return 200, nil
+}
+
+func jobWorker() {
+	for id := range jobs.queue {
+		job, err := readJob(id)
+		if err != nil {
+			log.Printf("failed to read job %s: %v", id, err)
+			continue
+		}
+		processJob(job)
+		queueWebhook(job)
+	}
+}
+
+func processJob(job *uploadJob) {
+	job.Status = jobProcessing
+	if err := writeJob(job); err != nil {
+		log.Printf("failed to save job %s: %v", job.ID, err)
+	}
+
+	path := filepath.Join(jobs.dir, job.ID)
+
+	upInfo, err := runJob(job, path)
+	if err != nil {
+		log.Printf("Error in job %s: %v", job.ID, err)
+		job.Status = jobFailed
+		job.Error = err.Error()
+	} else {
+		job.Status = jobDone
+		job.Result = upInfo
+	}
+
+	_ = os.Remove(path)
+	if err := writeJob(job); err != nil {
+		log.Printf("failed to save job %s: %v", job.ID, err)
+	}
+
+	Free()
+}
+
+func runJob(job *uploadJob, path string) (*UploadedInfo, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if err := uploadPool.wait(context.Background()); err != nil {
+		return nil, err
+	}
+	defer uploadPool.release()
+
+	ctx, cancel := processingContext(context.Background())
+	defer cancel()
+
+	return uploadPhoto(ctx, job.Key, file, job.Presets)
+}
+
+// queueWebhook hands finished job to webhook senders. If they are that far behind, notification is dropped, as the
+// job status is still available by /upload_status
+func queueWebhook(job *uploadJob) {
+	if jobs.webhooks == nil {
+		return
+	}
+	select {
+	case jobs.webhooks <- job:
+	default:
+		log.Printf("webhook queue is full, job %s isn't notified", job.ID)
+	}
+}
+
+func webhookSender(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-jobs.webhooks:
+			notifyWebhook(ctx, job)
+		}
+	}
+}
+
+// notifyWebhook posts finished job to the configured url. Body is signed by HMAC-SHA256 with webhook secret, so
+// receiver could check it came from us. Failed delivery is retried a few times and then given up. Each attempt is
+// limited by webhook timeout, and retries stop at once when ctx is done
+func notifyWebhook(ctx context.Context, job *uploadJob) {
+	body, _ := json.Marshal(job)
+
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		err := postWebhook(ctx, body)
+		if err == nil {
+			return
+		}
+		log.Printf("webhook for job %s failed (attempt %d): %v", job.ID, attempt, err)
+		if attempt == webhookAttempts {
+			return
+		}
+
+		timer := time.NewTimer(time.Duration(attempt) * 5 * time.Second)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			log.Printf("webhook for job %s given up: %v", job.ID, ctx.Err())
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+func postWebhook(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, jobs.conf.Webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if jobs.conf.WebhookSecret != "" {
+		mac := hmac.New(sha256.New, []byte(jobs.conf.WebhookSecret))
+		mac.Write(body)
+		req.Header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := jobs.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// pendingJobs finds jobs which weren't finished by previous run. Interrupted ones are processed again from start
+func pendingJobs() ([]string, error) {
+	entries, err := os.ReadDir(jobs.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []string
+	for _, entry := range entries {
+		id, isInfo := strings.CutSuffix(entry.Name(), ".json")
+		if !isInfo {
+			continue
+		}
+		job, err := readJob(id)
+		if err != nil {
+			log.Printf("failed to read job %s: %v", id, err)
+			continue
+		}
+		if job.Status == jobQueued || job.Status == jobProcessing {
+			pending = append(pending, id)
+		}
+	}
+	return pending, nil
+}
+
+func readJob(id string) (*uploadJob, error) {
+	jobs.mu.Lock()
+	defer jobs.mu.Unlock()
+
+	data, err := os.ReadFile(filepath.Join(jobs.dir, id+".json"))
+	if err != nil {
+		return nil, err
+	}
+	var job uploadJob
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, fmt.Errorf("broken job info %s: %w", id, err)
+	}
+	return &job, nil
+}
+
+// writeJob replaces job file atomically, so status requests never see it half-written
+func writeJob(job *uploadJob) error {
+	jobs.mu.Lock()
+	defer jobs.mu.Unlock()
+
+	data, _ := json.Marshal(job)
+	path := filepath.Join(jobs.dir, job.ID+".json")
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func removeJob(id string) {
+	jobs.mu.Lock()
+	defer jobs.mu.Unlock()
+
+	_ = os.Remove(filepath.Join(jobs.dir, id))
+	_ = os.Remove(filepath.Join(jobs.dir, id+".json"))
+}
+
+// removeExpiredJobs removes finished jobs older than expiration. Unfinished ones are left for workers
+func removeExpiredJobs() {
+	entries, err := os.ReadDir(jobs.dir)
+	if err != nil {
+		log.Printf("failed to read jobs directory: %v", err)
+		return
+	}
+
+	expiration := time.Duration(jobs.conf.Expiration) * time.Second
+	for _, entry := range entries {
+		id, isInfo := strings.CutSuffix(entry.Name(), ".json")
+		if !isInfo {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < expiration {
+			continue
+		}
+		if job, err := readJob(id); err == nil && (job.Status == jobDone || job.Status == jobFailed) {
+			removeJob(id)
+		}
+	}
+}
@@ -2,56 +2,369 @@ package main
 
 import (
 	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"html"
+	"log"
+	"maps"
 	"net/http"
 	"os"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
 
 	"github.com/levmv/imgserv/config"
 	"github.com/levmv/imgserv/storage"
 	"github.com/levmv/imgserv/vips"
 )
 
-var (
-	logo   storage.SourceImage
-	inited bool
-)
+// shareTemplate is config.ShareTemplate with defaults filled and colors parsed
+type shareTemplate struct {
+	config.ShareTemplate
+	bgColors     []vips.Color
+	overlayColor vips.Color
+	text         shareTextStyle
+	subtitle     shareTextStyle
+	hash         string // of resolved settings, so cached cards change with the config
+}
+
+// shareTextStyle is config.ShareText with defaults filled and colors parsed
+type shareTextStyle struct {
+	config.ShareText
+	color  vips.Color
+	shadow vips.Shadow
+}
+
+// shareAssets are images preloaded from storage: logos and backgrounds. Reload replaces the whole set, and request
+// keeps the one it started with, as vips reads buffers lazily until export
+type shareAssets struct {
+	images  map[string]storage.SourceImage // by path in storage
+	version string                         // hash of all contents, so cached cards change with them
+}
+
+// sharer is made from config.SharerConf. Config reload replaces it as a whole with the rest of settings
+type sharer struct {
+	templates map[string]*shareTemplate
+	sizes     map[string]config.ShareSize
+	logos     map[string]string
+	assets    atomic.Pointer[shareAssets]
+	stop      context.CancelFunc // stops assets reloading
+}
+
+// defaultShareTemplate is the original hard-coded layout: 1200x630 darkened image, white text in the middle of
+// 14x8 grid and logo above it
+var defaultShareTemplate = config.ShareTemplate{
+	Width:   1200,
+	Height:  630,
+	Quality: 90,
+	Overlay: config.ShareOverlay{Color: "#000000", Opacity: 0.4},
+	Text: config.ShareText{
+		ShareBox: config.ShareBox{X: 1.0 / 14, Y: 3.0 / 8, Width: 12.0 / 14, Height: 3.0 / 8},
+		Color:    "#ffffff",
+	},
+	Subtitle: config.ShareText{
+		ShareBox: config.ShareBox{X: 1.0 / 14, Y: 6.25 / 8, Width: 12.0 / 14, Height: 0.75 / 8},
+		MaxLines: 1,
+		Ellipsis: true,
+	},
+	Logo: config.ShareLogo{
+		ShareBox: config.ShareBox{X: 1.0 / 14, Y: 1.0 / 8},
+	},
+}
+
+// defaultShareSizes are recommended sizes of link previews
+var defaultShareSizes = map[string]config.ShareSize{
+	"og":        {Width: 1200, Height: 630},
+	"twitter":   {Width: 1200, Height: 600},
+	"vk":        {Width: 1074, Height: 480},
+	"telegram":  {Width: 1280, Height: 720},
+	"instagram": {Width: 1080, Height: 1080},
+}
+
+// warnUnsignedShare reminds that anyone could render cards with any text, when urls are not signed
+func warnUnsignedShare(conf *config.Config) {
+	if conf.Sharer != nil && conf.Resizer.SignatureSecret == "" {
+		log.Printf("Warning: resizer.signature_secret is empty, /share urls are not signed")
+	}
+}
+
+// newSharer prepares templates and loads their images. Nothing is used until setSettings
+func newSharer(ctx context.Context, conf *config.SharerConf) (*sharer, error) {
+	sh, paths, err := prepareSharer(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	loaded, err := loadShareAssets(ctx, paths)
+	if err != nil {
+		return nil, err
+	}
+	sh.assets.Store(loaded)
+
+	// Sharer may be made by request of /reload, but it outlives it
+	ctx, sh.stop = context.WithCancel(context.WithoutCancel(ctx))
+	if conf.ReloadInterval > 0 {
+		go sh.reloadAssets(ctx, paths, time.Duration(conf.ReloadInterval)*time.Second)
+	}
+
+	return sh, nil
+}
 
-func initSharer(ctx context.Context, conf *config.SharerConf) error {
+// prepareSharer checks settings and makes templates without loading anything from storage. Paths are images
+// in storage the templates need. All problems are reported at once
+func prepareSharer(conf *config.SharerConf) (*sharer, []string, error) {
+	sh := sharer{
+		templates: make(map[string]*shareTemplate),
+		sizes:     maps.Clone(defaultShareSizes),
+		logos:     conf.Logos,
+	}
+
+	maps.Copy(sh.sizes, conf.Sizes) // validated by config
 
-	//if conf.Font == "" && conf.Logo == "" {
-	//	return nil
-	//}
+	var errs []error
+	templates := maps.Clone(conf.Templates)
+	if templates == nil {
+		templates = make(map[string]config.ShareTemplate)
+	}
+	if _, ok := templates["default"]; !ok {
+		templates["default"] = defaultShareTemplate
+	}
+
+	var paths []string
+	for name, t := range templates {
+		tmpl, err := newShareTemplate(t, conf)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("template %s: %w", name, err))
+			continue
+		}
+		paths = append(paths, tmpl.Logo.Path, tmpl.Background.Image)
+		sh.templates[name] = tmpl
+	}
+	for _, path := range conf.Logos {
+		paths = append(paths, path)
+	}
+	slices.Sort(paths)
+	paths = slices.Compact(paths)
+	if len(paths) > 0 && paths[0] == "" {
+		paths = paths[1:]
+	}
+
+	return &sh, paths, errors.Join(errs...)
+}
+
+// loadShareAssets reads images from s3, not from the local cache, which would keep the old ones forever
+func loadShareAssets(ctx context.Context, paths []string) (*shareAssets, error) {
+	loaded := shareAssets{images: make(map[string]storage.SourceImage)}
+
+	hash := md5.New()
+	for _, path := range paths {
+		img, err := imgStorage.LoadFresh(ctx, path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to preload %s: %w", path, err)
+		}
+		loaded.images[path] = img
+		hash.Write([]byte(path))
+		hash.Write(img.Data)
+	}
+	loaded.version = hex.EncodeToString(hash.Sum(nil)[:8])
+
+	return &loaded, nil
+}
+
+// reloadAssets loads images again every interval, until the sharer is replaced. On SIGHUP they are loaded by
+// config reload. Failed reload keeps the current ones. Replaced buffers aren't returned to the pool, requests may
+// still use them
+func (sh *sharer) reloadAssets(ctx context.Context, paths []string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		loaded, err := loadShareAssets(ctx, paths)
+		if err != nil {
+			log.Printf("failed to reload share images: %v", err)
+			continue
+		}
+		if old := sh.assets.Swap(loaded); old.version != loaded.version {
+			log.Printf("share images reloaded, version %s", loaded.version)
+		}
+	}
+}
+
+func newShareTemplate(t config.ShareTemplate, conf *config.SharerConf) (*shareTemplate, error) {
+	tmpl := shareTemplate{
+		ShareTemplate: t,
+	}
+
+	if tmpl.Width <= 0 || tmpl.Height <= 0 {
+		tmpl.Width, tmpl.Height = defaultShareTemplate.Width, defaultShareTemplate.Height
+	}
+	if tmpl.Quality == 0 {
+		tmpl.Quality = defaultShareTemplate.Quality
+	}
+	if tmpl.Text.Width <= 0 || tmpl.Text.Height <= 0 {
+		return nil, errors.New("empty text box")
+	}
+	if tmpl.Logo.Path == "" {
+		tmpl.Logo.Path = conf.Logo
+	}
 
 	var err error
-	conf.FontFile, err = filepath.Abs(conf.FontFile)
+	if tmpl.bgColors, err = shareBackgroundColors(&tmpl.Background); err != nil {
+		return nil, fmt.Errorf("background: %w", err)
+	}
+	if tmpl.overlayColor, err = parseColor(tmpl.Overlay.Color); err != nil {
+		return nil, fmt.Errorf("overlay color: %w", err)
+	}
+
+	base := config.ShareText{Font: conf.Font, FontFile: conf.FontFile, Color: "#ffffff"}
+	if tmpl.text, err = newShareTextStyle(tmpl.Text, base); err != nil {
+		return nil, fmt.Errorf("text: %w", err)
+	}
+	if tmpl.hasSubtitle() {
+		if tmpl.subtitle, err = newShareTextStyle(tmpl.Subtitle, tmpl.text.ShareText); err != nil {
+			return nil, fmt.Errorf("subtitle: %w", err)
+		}
+	}
+
+	js, _ := json.Marshal([]any{tmpl.ShareTemplate, tmpl.text.ShareText, tmpl.subtitle.ShareText})
+	hash := md5.Sum(js)
+	tmpl.hash = hex.EncodeToString(hash[:])
+
+	return &tmpl, nil
+}
+
+// shareBackgroundColors checks background settings and parses its colors
+func shareBackgroundColors(bg *config.ShareBackground) ([]vips.Color, error) {
+	colors := 2
+	switch bg.Type {
+	case "":
+		return nil, nil
+	case config.ShareBackgroundColor:
+		colors = 1
+	case config.ShareBackgroundLinear, config.ShareBackgroundRadial:
+	case config.ShareBackgroundBlur:
+		if bg.Image == "" {
+			return nil, errors.New("no image for blur")
+		}
+		if bg.Blur <= 0 {
+			bg.Blur = 20
+		}
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown type %s", bg.Type)
+	}
+
+	if len(bg.Colors) != colors {
+		return nil, fmt.Errorf("%s needs %d colors", bg.Type, colors)
+	}
+	parsed := make([]vips.Color, colors)
+	for i, color := range bg.Colors {
+		var err error
+		if parsed[i], err = parseColor(color); err != nil {
+			return nil, err
+		}
+	}
+	return parsed, nil
+}
+
+func (tmpl *shareTemplate) hasSubtitle() bool {
+	return tmpl.Subtitle.Width > 0 && tmpl.Subtitle.Height > 0
+}
+
+// newShareTextStyle fills empty font and color from base
+func newShareTextStyle(t config.ShareText, base config.ShareText) (shareTextStyle, error) {
+	style := shareTextStyle{ShareText: t}
+
+	if style.Font == "" {
+		style.Font = base.Font
+	}
+	if style.FontFile == "" {
+		style.FontFile = base.FontFile
+	}
+	if style.Color == "" {
+		style.Color = base.Color
+	}
+	if style.MinScale <= 0 || style.MinScale > 1 {
+		style.MinScale = 0.5
+	}
+
+	switch style.Align {
+	case "", "left", "center", "right":
+	default:
+		return style, fmt.Errorf("unknown align %s", style.Align)
+	}
+
+	var err error
+	style.FontFile, err = filepath.Abs(style.FontFile)
 	if err != nil {
-		return fmt.Errorf("incorrect font file path: %w", err)
+		return style, fmt.Errorf("incorrect font file path: %w", err)
 	}
 
-	f, err := os.Open(conf.FontFile)
+	f, err := os.Open(style.FontFile)
 	if err != nil {
-		return fmt.Errorf("couldn't open fond file: %w", err)
+		return style, fmt.Errorf("couldn't open font file: %w", err)
 	}
 	f.Close()
 
-	logo, err = imgStorage.LoadImage(ctx, conf.Logo)
-	if err != nil {
-		return fmt.Errorf("failed to preload logo: %w", err)
+	if style.color, err = parseColor(style.Color); err != nil {
+		return style, fmt.Errorf("color: %w", err)
 	}
-	inited = true
 
-	return nil
+	style.shadow = vips.Shadow{Opacity: 1, Blur: 4}
+	if style.Shadow != nil {
+		if opacity := style.Shadow.Opacity; opacity != nil {
+			if *opacity < 0 || *opacity > 1 {
+				return style, fmt.Errorf("shadow opacity %v is out of 0..1", *opacity)
+			}
+			style.shadow.Opacity = *opacity
+		}
+		if blur := style.Shadow.Blur; blur != nil {
+			style.shadow.Blur = *blur
+		}
+		if style.shadow.Color, err = parseColor(style.Shadow.Color); err != nil {
+			return style, fmt.Errorf("shadow color: %w", err)
+		}
+	}
+
+	return style, nil
+}
+
+// parseColor reads color in "#rrggbb" form. Empty string means black
+func parseColor(s string) (vips.Color, error) {
+	if s == "" {
+		return vips.Color{}, nil
+	}
+	if len(s) != 7 || s[0] != '#' {
+		return vips.Color{}, fmt.Errorf("incorrect color %s", s)
+	}
+	rgb, err := strconv.ParseUint(s[1:], 16, 32)
+	if err != nil {
+		return vips.Color{}, fmt.Errorf("incorrect color %s", s)
+	}
+	return vips.Color{R: uint8(rgb >> 16), G: uint8(rgb >> 8), B: uint8(rgb)}, nil
 }
 
 func serveShareImg(w http.ResponseWriter, r *http.Request) (int, error) {
 
 	IncSharerRequests()
 
-	if inited == false {
+	st := current.Load()
+	sh := st.sharer
+	if sh == nil {
 		return 501, errors.New("sharer not set")
 	}
 
@@ -59,53 +372,197 @@ func serveShareImg(w http.ResponseWriter, r *http.Request) (int, error) {
 	defer DecRequestsInProgress()
 
 	q := r.URL.Query()
+	if err := st.sign.VerifyQuery(r.URL.Path, q); err != nil {
+		return 403, err
+	}
+
 	path := q.Get("key")
 	text := q.Get("text")
+	subtitle := q.Get("subtitle")
 	preview := q.Has("preview") && q.Get("preview") == "1"
 
-	if path == "" || text == "" {
-		return 500, errors.New("empty path or text params")
+	if text == "" {
+		return 400, errors.New("empty text param")
 	}
 
-	maxWidth := 1200.0
-	maxHeight := 630.0
+	templateName := q.Get("template")
+	if templateName == "" {
+		templateName = "default"
+	}
+	tmpl, ok := sh.templates[templateName]
+	if !ok {
+		return 400, fmt.Errorf("unknown template %s", templateName)
+	}
+	if path == "" && tmpl.Background.Type == "" {
+		return 400, fmt.Errorf("empty key param, and template %s has no background", templateName)
+	}
+	logoPath := tmpl.Logo.Path
+	logoName := q.Get("logo")
+	if logoName != "" {
+		if logoPath, ok = sh.logos[logoName]; !ok {
+			return 400, fmt.Errorf("unknown logo %s", logoName)
+		}
+	}
+	if subtitle != "" && !tmpl.hasSubtitle() {
+		return 400, fmt.Errorf("template %s has no subtitle", templateName)
+	}
+
+	maxWidth := float64(tmpl.Width)
+	maxHeight := float64(tmpl.Height)
+	quality := tmpl.Quality
+
+	sizeName := q.Get("size")
+	if sizeName != "" {
+		size, ok := sh.sizes[sizeName]
+		if !ok {
+			return 400, fmt.Errorf("unknown size %s", sizeName)
+		}
+		maxWidth = float64(size.Width)
+		maxHeight = float64(size.Height)
+	}
 
 	if preview {
 		maxWidth = maxWidth / 2
 		maxHeight = maxHeight / 2
+		quality = 60
 	}
 
 	ctx := r.Context()
+	images := sh.assets.Load()
+
+	// Crawlers of every network come for the same card, so it's worth caching
+	var cacheKey string
+	if imgStorage.OutputCache() {
+		var version string
+		var err error
+		if path != "" {
+			version, err = imgStorage.Version(ctx, path)
+			if errors.Is(err, storage.NotFoundError) {
+				return 404, fmt.Errorf("%v %s", err, path)
+			}
+		}
+		if err != nil {
+			log.Printf("failed to get version of %s, share card cache skipped: %v", path, err)
+		} else {
+			cacheKey = shareCacheKey(tmpl.hash, path, version, text, subtitle, logoPath, images.version,
+				strconv.Itoa(int(maxWidth)), strconv.Itoa(int(maxHeight)), strconv.Itoa(quality))
+			cached, err := imgStorage.LoadOutput(ctx, cacheKey)
+			defer cached.Close()
+			if err == nil {
+				return writeShareCard(w, r, cached.Data)
+			}
+			if !errors.Is(err, storage.NotCached) {
+				log.Printf("failed to load cached share card %s: %v", cacheKey, err)
+			}
+		}
+	}
 
-	if err := queueSem.Acquire(ctx, 1); err != nil {
-		panic("maxSem")
+	if err := sharePool.acquire(ctx); err != nil {
+		return sharePool.reject(w, err)
 	}
-	defer queueSem.Release(1)
+	defer sharePool.release()
+
+	ctx, cancel := processingContext(ctx)
+	defer cancel()
+
+	var sourceData []byte
+	if path != "" {
+		sourceImg, err := imgStorage.LoadImage(ctx, path)
+		defer sourceImg.Close()
+		if err != nil {
+			if errors.Is(err, storage.NotFoundError) {
+				return 404, fmt.Errorf("%v %s", err, path)
+			}
+			return processingError(ctx, err)
+		}
 
-	sourceImg, err := imgStorage.LoadImage(ctx, path)
-	defer sourceImg.Close()
-	if err != nil {
-		if errors.Is(err, storage.NotFoundError) {
-			return 404, fmt.Errorf("%v %s", err, path)
+		if err := checkInput(sourceImg.Data); err != nil {
+			return processingError(ctx, fmt.Errorf("%s: %w", path, err))
 		}
-		return 500, err
+		sourceData = sourceImg.Data
 	}
 
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
 
+	canceler := vips.NewCanceler(ctx)
+	defer canceler.Close()
+
 	image := vips.Image{}
 	defer image.Close()
 	defer vips.Cleanup()
 
-	if err = image.LoadFromBuffer(sourceImg.Data); err != nil {
-		return 500, fmt.Errorf("failed to load. %v", err)
+	if sourceData != nil {
+		if err := shareImage(&image, canceler, sourceData, maxWidth, maxHeight); err != nil {
+			return processingError(ctx, fmt.Errorf("%s: %w", path, err))
+		}
+	} else {
+		if err := shareBackground(&image, tmpl, images, int(maxWidth), int(maxHeight)); err != nil {
+			return processingError(ctx, err)
+		}
+	}
+
+	if err := drawShareCard(&image, tmpl, images.images[logoPath], text, subtitle); err != nil {
+		return processingError(ctx, err)
+	}
+
+	canceler.Attach(&image)
+	imageBytes, err := image.ExportJpeg(quality)
+	runtime.KeepAlive(images)
+	if err != nil {
+		return processingError(ctx, err)
+	}
+
+	if cacheKey != "" {
+		if err := imgStorage.SaveOutput(cacheKey, imageBytes); err != nil {
+			log.Printf("failed to save share card %s: %v", cacheKey, err)
+		}
+	}
+
+	return writeShareCard(w, r, imageBytes)
+}
+
+// shareCacheKey names the card in the output cache. Besides request params it includes everything the card is made
+// from: template settings, resulting size, source and assets versions
+func shareCacheKey(params ...string) string {
+	hash := md5.Sum([]byte(strings.Join(params, "\x00")))
+	return "share/" + hex.EncodeToString(hash[:]) + ".jpg"
+}
+
+// writeShareCard responds with the card, or with 304 if client already has it. ETag is made from the content, so
+// it stays the same for cached and freshly rendered card
+func writeShareCard(w http.ResponseWriter, r *http.Request, data []byte) (int, error) {
+	hash := md5.Sum(data)
+	etag := `"` + hex.EncodeToString(hash[:]) + `"`
+
+	w.Header().Set("ETag", etag)
+	if strings.Contains(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return 304, nil
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	_, err := w.Write(data)
+
+	return 200, err
+}
+
+// shareImage loads the image into canvas of maxWidth x maxHeight proportions, but not bigger than the image itself
+func shareImage(image *vips.Image, canceler *vips.Canceler, data []byte, maxWidth float64, maxHeight float64) error {
+	if err := image.LoadFromBuffer(data); err != nil {
+		return fmt.Errorf("failed to load. %v", err)
+	}
+	canceler.Attach(image)
+
+	if err := checkDimensions(image); err != nil {
+		return err
 	}
 
 	ratio := maxWidth / maxHeight
 	width := int(maxWidth)
 	height := int(maxHeight)
-	if float64(image.Width()/image.Height()) > ratio {
+	if float64(image.Width())/float64(image.Height()) > ratio {
 		if image.Height() < int(maxHeight) {
 			height = image.Height()
 			width = int(float64(image.Height()) * ratio)
@@ -117,50 +574,215 @@ func serveShareImg(w http.ResponseWriter, r *http.Request) (int, error) {
 		}
 	}
 
-	scale := float64(image.Width()) / maxWidth
+	return image.Thumbnail(width, height, vips.InterestingAttention, vips.SizeDown)
+}
 
-	if err = image.Thumbnail(width, height, vips.InterestingAttention, vips.SizeDown); err != nil {
-		return 500, err
+// shareBackground generates canvas for card without image, see config.ShareBackground
+func shareBackground(image *vips.Image, tmpl *shareTemplate, images *shareAssets, width int, height int) error {
+	bg := tmpl.Background
+
+	switch bg.Type {
+	case config.ShareBackgroundColor:
+		return image.Gradient(width, height, tmpl.bgColors[0], tmpl.bgColors[0], false, 0)
+	case config.ShareBackgroundLinear:
+		return image.Gradient(width, height, tmpl.bgColors[0], tmpl.bgColors[1], false, bg.Angle)
+	case config.ShareBackgroundRadial:
+		return image.Gradient(width, height, tmpl.bgColors[0], tmpl.bgColors[1], true, 0)
 	}
 
-	divHor := 14.0
-	divVer := 8.0
+	if err := image.LoadFromBuffer(images.images[bg.Image].Data); err != nil {
+		return err
+	}
+	if err := image.Thumbnail(width, height, vips.InterestingCentre, vips.SizeBoth); err != nil {
+		return err
+	}
+	return image.Blur(bg.Blur * float64(width) / float64(tmpl.Width))
+}
 
-	lineH := int(float64(image.Width()) / divHor)
-	lineV := int(float64(image.Height()) / divVer)
+// drawShareCard puts overlay, text and logo of the template on the canvas. Canvas may have other proportions than
+// the template one, so text and logo are scaled by the shorter side: positions are relative, but nothing grows
+// just because the canvas is taller or wider
+func drawShareCard(image *vips.Image, tmpl *shareTemplate, logo storage.SourceImage, text string, subtitle string) error {
+	width := float64(image.Width())
+	height := float64(image.Height())
+	scale := min(width/float64(tmpl.Width), height/float64(tmpl.Height))
+
+	overlay := tmpl.Overlay
+	if overlay.Opacity > 0 || overlay.Gradient {
+		bottom := overlay.Opacity
+		if overlay.Gradient {
+			bottom = overlay.GradientOpacity
+		}
+		if err := image.Overlay(tmpl.overlayColor, overlay.Opacity, bottom); err != nil {
+			return err
+		}
+	}
 
-	if err := image.Linear(0.6, 0); err != nil {
-		return 500, err
+	if err := drawShareText(image, &tmpl.text, text, float64(tmpl.Height), scale); err != nil {
+		return err
+	}
+	if subtitle != "" {
+		if err := drawShareText(image, &tmpl.subtitle, subtitle, float64(tmpl.Height), scale); err != nil {
+			return err
+		}
 	}
 
-	if err := image.Label(text, cfg.Sharer.Font, cfg.Sharer.FontFile, vips.Color{255, 255, 255},
-		lineH, lineV*3, image.Width()-lineH*2, lineV*3); err != nil {
-		return 500, err
+	if logo.Data == nil {
+		return nil
 	}
 
 	logoImage := vips.Image{}
 	defer logoImage.Close()
 
-	if err = logoImage.LoadFromBuffer(logo.Data); err != nil {
-		return 500, err
+	if err := logoImage.LoadFromBuffer(logo.Data); err != nil {
+		return err
 	}
-	if scale != 1 {
-		logoImage.Resize(scale)
+
+	logoScale := scale
+	if tmpl.Logo.Width > 0 {
+		logoScale = tmpl.Logo.Width * float64(tmpl.Width) * scale / float64(logoImage.Width())
+	}
+	if logoScale != 1 {
+		if err := logoImage.Resize(logoScale); err != nil {
+			return err
+		}
 	}
 
-	logoImage.Embed(lineH, lineV, image.Width(), image.Height())
-	if err = image.Composite(&logoImage); err != nil {
-		return 500, err
+	if err := logoImage.Embed(int(tmpl.Logo.X*width), int(tmpl.Logo.Y*height), image.Width(), image.Height()); err != nil {
+		return err
 	}
+	return image.Composite(&logoImage)
+}
 
-	quality := 90
-	if preview {
-		quality = 60
+// drawShareText renders text into its box. Box height is limited by the template height scaled to the canvas, so
+// the font doesn't grow on tall canvases
+func drawShareText(image *vips.Image, style *shareTextStyle, text string, templateHeight float64, scale float64) error {
+	width := float64(image.Width())
+	height := float64(image.Height())
+
+	box := style.ShareBox
+	boxWidth := int(box.Width * width)
+	boxHeight := int(box.Height * min(height, templateHeight*scale))
+	align := style.align(text)
+
+	mask := vips.Image{}
+	defer mask.Close()
+
+	if err := shareText(&mask, text, style, align, boxWidth, boxHeight); err != nil {
+		return err
 	}
-	imageBytes, _ := image.ExportJpeg(quality)
-	w.Header().Set("Content-Type", "image/jpeg")
-	w.Header().Set("Content-Length", strconv.Itoa(len(imageBytes)))
-	_, err = w.Write(imageBytes)
 
-	return 200, nil
+	x := int(box.X * width)
+	switch align {
+	case vips.AlignCentre:
+		x += (boxWidth - mask.Width()) / 2
+	case vips.AlignHigh:
+		x += boxWidth - mask.Width()
+	}
+
+	shadow := style.shadow
+	shadow.Blur *= scale
+
+	return image.DrawMask(&mask, style.color, x, int(box.Y*height), shadow)
+}
+
+// align picks alignment of the text. Left and right are swapped for RTL text, so "left" means the start of lines
+func (style *shareTextStyle) align(text string) vips.Align {
+	align := style.Align
+	if isRTL(text) {
+		switch align {
+		case "", "left":
+			align = "right"
+		case "right":
+			align = "left"
+		}
+	}
+
+	switch align {
+	case "center":
+		return vips.AlignCentre
+	case "right":
+		return vips.AlignHigh
+	}
+	return vips.AlignLow
+}
+
+// isRTL tells whether text direction is right-to-left by its first strong letter, the same way pango does
+func isRTL(text string) bool {
+	for _, r := range text {
+		if unicode.In(r, unicode.Hebrew, unicode.Arabic, unicode.Syriac, unicode.Thaana, unicode.Nko) {
+			return true
+		}
+		if unicode.IsLetter(r) {
+			return false
+		}
+	}
+	return false
+}
+
+// shareText renders text mask for the box. Text isn't markup, so it's escaped, but explicit line breaks are kept.
+// Without MaxLines the font is sized by vips to fit the box. Otherwise it starts from the size filling the box
+// with that many lines and shrinks until the text fits, see config.ShareText
+func shareText(mask *vips.Image, text string, style *shareTextStyle, align vips.Align, width int, height int) error {
+	if style.MaxLines <= 0 {
+		return mask.Text(html.EscapeString(text), style.Font, style.FontFile, width, height, 0, align)
+	}
+
+	// Height of one line at 72 dpi is what dpi is scaled from
+	if err := mask.Text("Ag", style.Font, style.FontFile, width, 0, 72, align); err != nil {
+		return err
+	}
+	lineHeight := float64(mask.Height()) / 72
+
+	dpi := 0
+	render := func(text string) (bool, error) {
+		if err := mask.Text(html.EscapeString(text), style.Font, style.FontFile, width, 0, dpi, align); err != nil {
+			return false, err
+		}
+		// line spacing isn't exactly the height of one line, so half a line is tolerated
+		return float64(mask.Height()) <= (float64(style.MaxLines)+0.5)*lineHeight*float64(dpi), nil
+	}
+
+	dpi = max(int(float64(height)/(float64(style.MaxLines)*lineHeight)), 1)
+	minDpi := max(int(float64(dpi)*style.MinScale), 1)
+
+	for {
+		fits, err := render(text)
+		if err != nil || fits {
+			return err
+		}
+		if dpi <= minDpi {
+			break
+		}
+		dpi = max(dpi*9/10, minDpi)
+	}
+
+	if style.Ellipsis {
+		// The longest start of the text, by words, which fits with ellipsis
+		words := strings.Split(text, " ")
+		best := 0
+		for lo, hi := 1, len(words)-1; lo <= hi; {
+			n := (lo + hi) / 2
+			fits, err := render(strings.Join(words[:n], " ") + "…")
+			if err != nil {
+				return err
+			}
+			if fits {
+				best, lo = n, n+1
+			} else {
+				hi = n - 1
+			}
+		}
+		if best > 0 {
+			text = strings.Join(words[:best], " ") + "…"
+		}
+		if _, err := render(text); err != nil {
+			return err
+		}
+	}
+
+	if mask.Height() > height {
+		return mask.Crop(0, 0, mask.Width(), height)
+	}
+	return nil
 }
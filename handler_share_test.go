@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/levmv/imgserv/config"
+	"github.com/levmv/imgserv/vips"
+)
+
+func TestShareShadow(t *testing.T) {
+	font := filepath.Join(t.TempDir(), "font.ttf")
+	if err := os.WriteFile(font, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	half, none, blur := 0.5, 0.0, 2.0
+	var tests = []struct {
+		name    string
+		shadow  *config.ShareShadow
+		want    vips.Shadow
+		wantErr bool
+	}{
+		{"default", nil, vips.Shadow{Opacity: 1, Blur: 4}, false},
+		{"color only", &config.ShareShadow{Color: "#ff0000"}, vips.Shadow{Color: vips.Color{R: 255}, Opacity: 1, Blur: 4}, false},
+		{"opacity", &config.ShareShadow{Opacity: &half}, vips.Shadow{Opacity: 0.5, Blur: 4}, false},
+		{"disabled", &config.ShareShadow{Opacity: &none}, vips.Shadow{Blur: 4}, false},
+		{"blur", &config.ShareShadow{Blur: &blur}, vips.Shadow{Opacity: 1, Blur: 2}, false},
+		{"too opaque", &config.ShareShadow{Opacity: &blur}, vips.Shadow{}, true},
+	}
+
+	for _, tt := range tests {
+		style, err := newShareTextStyle(config.ShareText{FontFile: font, Shadow: tt.shadow}, config.ShareText{})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v", tt.name, err)
+			continue
+		}
+		if err == nil && style.shadow != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, style.shadow, tt.want)
+		}
+	}
+}
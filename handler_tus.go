@@ -0,0 +1,446 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/levmv/imgserv/config"
+)
+
+// Resumable uploads by tus protocol (https://tus.io/protocols/resumable-upload) with creation, termination and
+// expiration extensions. Chunks are appended to a file in the spool directory, and the completed file goes through
+// the usual uploadPhoto. Response to the last PATCH has UploadedInfo in its body, also it's available by GET later
+
+const tusVersion = "1.0.0"
+
+type tusUpload struct {
+	Length   int64         `json:"length"`
+	Key      string        `json:"key"`
+	Metadata string        `json:"metadata,omitempty"`
+	Result   *UploadedInfo `json:"result,omitempty"`
+}
+
+var (
+	tusDir        string
+	tusExpiration time.Duration
+	tusLocks      sync.Map
+	tusSpool      struct {
+		conf   config.TusConf
+		mu     sync.Mutex
+		open   map[string]int64 // lengths of unfinished uploads by id
+		length int64            // their sum
+	}
+)
+
+func initTus(conf config.TusConf) error {
+	var err error
+	tusDir, err = imgStorage.SpoolDir("tus")
+	if err != nil {
+		return err
+	}
+	tusExpiration = time.Duration(conf.Expiration) * time.Second
+
+	tusSpool.conf = conf
+	tusSpool.open = make(map[string]int64)
+	if err := loadTusSpool(); err != nil {
+		return err
+	}
+
+	if tusExpiration > 0 {
+		go func() {
+			ticker := time.NewTicker(time.Hour)
+			defer ticker.Stop()
+			for range ticker.C {
+				removeExpiredTus()
+			}
+		}()
+	}
+	return nil
+}
+
+func TusHandler(w http.ResponseWriter, r *http.Request) (int, error) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", "creation,termination,expiration")
+		if maxSize := current.Load().conf.Limits.MaxFileSize; maxSize > 0 {
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(maxSize, 10))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return 204, nil
+	}
+
+	if r.Header.Get("Tus-Resumable") != tusVersion && r.Method != http.MethodGet {
+		w.Header().Set("Tus-Version", tusVersion)
+		return 412, fmt.Errorf("unsupported tus version %s", r.Header.Get("Tus-Resumable"))
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/tus"), "/")
+
+	if id == "" {
+		if r.Method != http.MethodPost {
+			return 405, fmt.Errorf("method %s is not allowed", r.Method)
+		}
+		return tusCreate(w, r)
+	}
+
+	if !isUuid(id) {
+		return 404, fmt.Errorf("incorrect upload id %s", id)
+	}
+
+	// Locks are made for existing uploads only, so requests with random ids don't leave them behind
+	if _, err := os.Stat(filepath.Join(tusDir, id+".json")); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return 404, fmt.Errorf("upload not found %s", id)
+		}
+		return 500, err
+	}
+
+	lock, ok := tryLockTus(id)
+	if !ok {
+		return 409, fmt.Errorf("upload %s is locked by another request", id)
+	}
+	defer lock.Unlock()
+
+	// It could be removed while we were taking the lock
+	upload, err := readTusUpload(id)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			tusLocks.CompareAndDelete(id, lock)
+			return 404, fmt.Errorf("upload not found %s", id)
+		}
+		return 500, err
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		return tusHead(w, id, upload)
+	case http.MethodPatch:
+		return tusPatch(w, r, id, upload)
+	case http.MethodGet:
+		if upload.Result == nil {
+			return 409, fmt.Errorf("upload %s is not completed", id)
+		}
+		js, _ := json.Marshal(upload.Result)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(js)
+		return 200, nil
+	case http.MethodDelete:
+		removeTus(id)
+		w.WriteHeader(http.StatusNoContent)
+		return 204, nil
+	}
+
+	return 405, fmt.Errorf("method %s is not allowed", r.Method)
+}
+
+func tusCreate(w http.ResponseWriter, r *http.Request) (int, error) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		return 400, fmt.Errorf("incorrect Upload-Length %s", r.Header.Get("Upload-Length"))
+	}
+	if maxSize := current.Load().conf.Limits.MaxFileSize; maxSize > 0 && length > maxSize {
+		return 413, fmt.Errorf("%w: %d bytes", errInputTooLarge, length)
+	}
+
+	metadata := r.Header.Get("Upload-Metadata")
+	if _, err := requestedPresets(tusMetadataValue(metadata, "presets")); err != nil {
+		return 400, err
+	}
+
+	upload := tusUpload{
+		Length:   length,
+		Key:      tusMetadataValue(metadata, "key"),
+		Metadata: metadata,
+	}
+
+	id, err := genUuid()
+	if err != nil {
+		return 500, err
+	}
+
+	if status, err := reserveTusSpool(id, length); err != nil {
+		if status == http.StatusServiceUnavailable {
+			w.Header().Set("Retry-After", "60")
+		}
+		return status, err
+	}
+
+	file, err := os.Create(filepath.Join(tusDir, id))
+	if err != nil {
+		releaseTusSpool(id)
+		return 500, err
+	}
+	file.Close()
+
+	if err := writeTusUpload(id, &upload); err != nil {
+		removeTus(id)
+		return 500, err
+	}
+
+	w.Header().Set("Location", strings.TrimSuffix(r.URL.Path, "/")+"/"+id)
+	setTusExpires(w)
+	w.WriteHeader(http.StatusCreated)
+	return 201, nil
+}
+
+func tusHead(w http.ResponseWriter, id string, upload *tusUpload) (int, error) {
+	offset := upload.Length
+	if upload.Result == nil {
+		info, err := os.Stat(filepath.Join(tusDir, id))
+		if err != nil {
+			return 500, err
+		}
+		offset = info.Size()
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	if upload.Metadata != "" {
+		w.Header().Set("Upload-Metadata", upload.Metadata)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	return 200, nil
+}
+
+func tusPatch(w http.ResponseWriter, r *http.Request, id string, upload *tusUpload) (int, error) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		return 415, fmt.Errorf("incorrect content type %s", r.Header.Get("Content-Type"))
+	}
+	if upload.Result != nil {
+		return 409, fmt.Errorf("upload %s is already completed", id)
+	}
+
+	path := filepath.Join(tusDir, id)
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return 500, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 500, err
+	}
+
+	offset := info.Size()
+	if r.Header.Get("Upload-Offset") != strconv.FormatInt(offset, 10) {
+		return 409, fmt.Errorf("upload %s offset mismatch: %s instead of %d", id, r.Header.Get("Upload-Offset"), offset)
+	}
+
+	// Whatever was received before the connection broke is kept, client will resume from there
+	written, err := io.Copy(file, io.LimitReader(r.Body, upload.Length-offset))
+	offset += written
+	if err != nil {
+		return 500, fmt.Errorf("upload %s interrupted at %d: %w", id, offset, err)
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+
+	if offset < upload.Length {
+		setTusExpires(w)
+		w.WriteHeader(http.StatusNoContent)
+		return 204, nil
+	}
+
+	presets, err := requestedPresets(tusMetadataValue(upload.Metadata, "presets"))
+	if err != nil {
+		removeTus(id)
+		return 400, err
+	}
+
+	data, err := os.Open(path)
+	if err != nil {
+		return 500, err
+	}
+	defer data.Close()
+
+	if err := uploadPool.acquire(r.Context()); err != nil {
+		return uploadPool.reject(w, err)
+	}
+	defer uploadPool.release()
+
+	ctx, cancel := processingContext(r.Context())
+	defer cancel()
+
+	// Bad input is discarded, but after timeout or cancel the client could try to finish it again
+	upInfo, err := uploadPhoto(ctx, upload.Key, data, presets)
+	if err != nil {
+		if isInputError(err) {
+			removeTus(id)
+		}
+		return processingError(ctx, err)
+	}
+
+	upload.Result = upInfo
+	if err := writeTusUpload(id, upload); err != nil {
+		log.Printf("failed to save result of upload %s: %v", id, err)
+	}
+	_ = os.Remove(path)
+	releaseTusSpool(id)
+
+	js, _ := json.Marshal(upInfo)
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(js)
+
+	Free()
+
+	return 200, nil
+}
+
+// tusMetadataValue extracts value from Upload-Metadata header: comma separated pairs of key and base64 value
+func tusMetadataValue(metadata string, key string) string {
+	for _, pair := range strings.Split(metadata, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if k == key {
+			value, _ := base64.StdEncoding.DecodeString(v)
+			return string(value)
+		}
+	}
+	return ""
+}
+
+func readTusUpload(id string) (*tusUpload, error) {
+	data, err := os.ReadFile(filepath.Join(tusDir, id+".json"))
+	if err != nil {
+		return nil, err
+	}
+	var upload tusUpload
+	if err := json.Unmarshal(data, &upload); err != nil {
+		return nil, fmt.Errorf("broken upload info %s: %w", id, err)
+	}
+	return &upload, nil
+}
+
+func writeTusUpload(id string, upload *tusUpload) error {
+	data, _ := json.Marshal(upload)
+	return os.WriteFile(filepath.Join(tusDir, id+".json"), data, 0644)
+}
+
+func removeTus(id string) {
+	_ = os.Remove(filepath.Join(tusDir, id))
+	_ = os.Remove(filepath.Join(tusDir, id+".json"))
+	releaseTusSpool(id)
+	tusLocks.Delete(id)
+}
+
+// reserveTusSpool counts new upload in spool limits. Upload which alone is larger than the spool gets 413, others
+// are refused with 503 until some of the open ones are finished or expired
+func reserveTusSpool(id string, length int64) (int, error) {
+	tusSpool.mu.Lock()
+	defer tusSpool.mu.Unlock()
+
+	conf := tusSpool.conf
+	if conf.MaxSpoolSize > 0 && length > conf.MaxSpoolSize {
+		return http.StatusRequestEntityTooLarge, fmt.Errorf("%w: %d bytes is more than tus spool size", errInputTooLarge,
+			length)
+	}
+	if conf.MaxUploads > 0 && len(tusSpool.open) >= conf.MaxUploads {
+		return http.StatusServiceUnavailable, fmt.Errorf("too many open uploads: %d", len(tusSpool.open))
+	}
+	if conf.MaxSpoolSize > 0 && tusSpool.length+length > conf.MaxSpoolSize {
+		return http.StatusServiceUnavailable, fmt.Errorf("tus spool is full: %d bytes reserved", tusSpool.length)
+	}
+
+	tusSpool.open[id] = length
+	tusSpool.length += length
+	return 0, nil
+}
+
+// releaseTusSpool removes finished or removed upload from spool limits, it's safe to call it more than once
+func releaseTusSpool(id string) {
+	tusSpool.mu.Lock()
+	defer tusSpool.mu.Unlock()
+
+	if length, ok := tusSpool.open[id]; ok {
+		delete(tusSpool.open, id)
+		tusSpool.length -= length
+	}
+}
+
+// loadTusSpool counts unfinished uploads left from previous run
+func loadTusSpool() error {
+	entries, err := os.ReadDir(tusDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		id, isInfo := strings.CutSuffix(entry.Name(), ".json")
+		if !isInfo {
+			continue
+		}
+		upload, err := readTusUpload(id)
+		if err != nil {
+			log.Printf("failed to read upload %s: %v", id, err)
+			continue
+		}
+		if upload.Result == nil {
+			tusSpool.open[id] = upload.Length
+			tusSpool.length += upload.Length
+		}
+	}
+	return nil
+}
+
+func setTusExpires(w http.ResponseWriter) {
+	if tusExpiration > 0 {
+		w.Header().Set("Upload-Expires", time.Now().Add(tusExpiration).UTC().Format(http.TimeFormat))
+	}
+}
+
+// removeExpiredTus removes uploads (both finished and not) which files weren't modified for tusExpiration
+func removeExpiredTus() {
+	entries, err := os.ReadDir(tusDir)
+	if err != nil {
+		log.Printf("failed to read tus directory: %v", err)
+		return
+	}
+
+	for _, entry := range entries {
+		id, isInfo := strings.CutSuffix(entry.Name(), ".json")
+		if !isInfo {
+			continue
+		}
+
+		path := filepath.Join(tusDir, id)
+		info, err := os.Stat(path)
+		if err != nil {
+			// completed upload has no data file anymore
+			info, err = entry.Info()
+		}
+		if err != nil || time.Since(info.ModTime()) <= tusExpiration {
+			continue
+		}
+
+		// Upload in use by a request isn't expired, whatever its time is
+		lock, ok := tryLockTus(id)
+		if !ok {
+			continue
+		}
+		removeTus(id)
+		lock.Unlock()
+	}
+}
+
+// tryLockTus takes the lock of upload without waiting, false means another request holds it
+func tryLockTus(id string) (*sync.Mutex, bool) {
+	lock, _ := tusLocks.LoadOrStore(id, &sync.Mutex{})
+	mu := lock.(*sync.Mutex)
+	return mu, mu.TryLock()
+}
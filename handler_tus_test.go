@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/levmv/imgserv/config"
+)
+
+func TestTusSpoolLimits(t *testing.T) {
+	tusSpool.conf = config.TusConf{MaxUploads: 2, MaxSpoolSize: 100}
+	tusSpool.open = make(map[string]int64)
+	defer func() { tusSpool.conf, tusSpool.open, tusSpool.length = config.TusConf{}, nil, 0 }()
+
+	var tests = []struct {
+		id      string
+		length  int64
+		status  int
+		release string // id released after the reservation
+	}{
+		{"a", 101, 413, ""},
+		{"a", 60, 0, ""},
+		{"b", 50, 503, ""}, // 110 bytes in spool
+		{"b", 40, 0, ""},
+		{"c", 1, 503, "a"}, // too many uploads
+		{"c", 60, 0, "a"},  // a is released twice, it's counted once
+		{"d", 1, 503, ""},
+	}
+
+	for i, tt := range tests {
+		status, err := reserveTusSpool(tt.id, tt.length)
+		if status != tt.status || (err == nil) != (tt.status == 0) {
+			t.Errorf("%d: reserving %s of %d: got %d, %v, want %d", i, tt.id, tt.length, status, err, tt.status)
+		}
+		if tt.status == 413 && !errors.Is(err, errInputTooLarge) {
+			t.Errorf("%d: got %v", i, err)
+		}
+		if tt.release != "" {
+			releaseTusSpool(tt.release)
+		}
+	}
+
+	if len(tusSpool.open) != 2 || tusSpool.length != 100 {
+		t.Errorf("got %d uploads of %d bytes, want 2 of 100", len(tusSpool.open), tusSpool.length)
+	}
+}
+
+func TestRemoveExpiredTusSkipsLocked(t *testing.T) {
+	oldDir, oldExpiration := tusDir, tusExpiration
+	tusDir, tusExpiration = t.TempDir(), time.Minute
+	defer func() { tusDir, tusExpiration = oldDir, oldExpiration }()
+
+	old := time.Now().Add(-time.Hour)
+	for _, id := range []string{"locked", "free"} {
+		for _, name := range []string{id, id + ".json"} {
+			path := filepath.Join(tusDir, name)
+			if err := os.WriteFile(path, []byte("{}"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(path, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	lock, ok := tryLockTus("locked")
+	if !ok {
+		t.Fatal("can't lock upload")
+	}
+	removeExpiredTus()
+	lock.Unlock()
+	defer tusLocks.Delete("locked")
+
+	if _, err := os.Stat(filepath.Join(tusDir, "locked.json")); err != nil {
+		t.Errorf("locked upload is removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tusDir, "free.json")); !os.IsNotExist(err) {
+		t.Errorf("expired upload is left: %v", err)
+	}
+}
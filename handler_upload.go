@@ -1,38 +1,106 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"log"
+	"mime"
 	"net/http"
 	"os"
+	"path/filepath"
 	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"syscall"
 
 	"github.com/levmv/imgserv/config"
+	"github.com/levmv/imgserv/params"
 	"github.com/levmv/imgserv/vips"
 )
 
 type UploadedInfo struct {
-	Name   string `json:"name"`
-	Width  int    `json:"width"`
-	Height int    `json:"height"`
+	Name           string              `json:"name"`
+	Width          int                 `json:"width"`
+	Height         int                 `json:"height"`
+	Format         config.OutputFormat `json:"format"`
+	Size           int                 `json:"size"`
+	Hash           string              `json:"hash"`
+	HasAlpha       bool                `json:"has_alpha"`
+	DominantColor  string              `json:"dominant_color"`
+	BlurHash       string              `json:"blurhash"`
+	OriginalFormat string              `json:"original_format"`
+	OriginalWidth  int                 `json:"original_width"`
+	OriginalHeight int                 `json:"original_height"`
+	Orientation    int                 `json:"orientation"`
+	Deduplicated   bool                `json:"deduplicated,omitempty"`
+	Derivatives    []string            `json:"derivatives,omitempty"`
 }
 
-type preprocessor func(image *vips.Image) error
+var (
+	uploadRules []config.UploadConf
+	keyHash     string
+)
 
-func nope(image *vips.Image) error {
-	return nil
+var defaultUploadQuality = map[config.OutputFormat]int{
+	config.OutputTypeJpeg: 95,
+	config.OutputTypeWebp: 90,
+	config.OutputTypeAvif: 75,
 }
 
-var (
-	preprocess preprocessor
-	maxWidth   int
-	maxHeight  int
-)
+// initUpload prepares rules for uploadRule: fills defaults and sorts them from the longest prefix to the shortest
+func initUpload(conf config.StorageConf) {
+	rules := slices.Clone(conf.Upload)
+	if !slices.ContainsFunc(rules, func(rule config.UploadConf) bool { return rule.Prefix == "" }) {
+		rules = append(rules, config.UploadConf{})
+	}
+
+	for i := range rules {
+		if rules[i].Format == "" {
+			rules[i].Format = config.OutputTypeJpeg
+		}
+		if rules[i].MaxWidth == 0 && rules[i].MaxHeight == 0 {
+			rules[i].MaxWidth = conf.MaxWidth
+			rules[i].MaxHeight = conf.MaxHeight
+		}
+	}
+
+	sort.SliceStable(rules, func(i, j int) bool {
+		return len(rules[i].Prefix) > len(rules[j].Prefix)
+	})
+
+	uploadRules = rules
+	keyHash = conf.KeyHash
+}
+
+// uploadRule picks the rule with the longest prefix of key. Generated keys are random or made from the result, so
+// they can't choose the rule: empty key gets the rule without prefix
+func uploadRule(key string) config.UploadConf {
+	defaultRule := uploadRules[len(uploadRules)-1]
+	if key == "" {
+		return defaultRule
+	}
+	for _, rule := range uploadRules {
+		if strings.HasPrefix(key, rule.Prefix) {
+			return rule
+		}
+	}
+	return defaultRule
+}
 
-func resize(image *vips.Image) error {
+func fitInto(image *vips.Image, maxWidth int, maxHeight int) error {
+	if maxWidth <= 0 || maxHeight <= 0 {
+		return nil
+	}
 	if image.Width() > maxWidth || image.Height() > maxHeight {
 		if err := image.Thumbnail(maxWidth, maxHeight, 0, vips.SizeDown); err != nil {
 			return err
@@ -41,13 +109,56 @@ func resize(image *vips.Image) error {
 	return nil
 }
 
-func initUpload(conf config.StorageConf) {
-	if conf.MaxWidth > 0 && conf.MaxHeight > 0 {
-		maxWidth = conf.MaxWidth
-		maxHeight = conf.MaxHeight
-		preprocess = resize
-	} else {
-		preprocess = nope
+// originalFormat picks output format closest to the input one among those we are able to save. Vips loads only
+// the first frame, so animations get OutputTypeOriginal: they are saved as they are
+func originalFormat(loader string, pages int) config.OutputFormat {
+	switch loader {
+	case "gif":
+		if pages > 1 {
+			return config.OutputTypeOriginal
+		}
+		return config.OutputTypePng
+	case "png":
+		return config.OutputTypePng
+	case "webp":
+		if pages > 1 {
+			return config.OutputTypeOriginal
+		}
+		return config.OutputTypeWebp
+	case "heif":
+		return config.OutputTypeAvif
+	default:
+		return config.OutputTypeJpeg
+	}
+}
+
+// checkAnimation makes sure animation fits the upload rule, as it's saved as it is: it can't be resized or rotated.
+// Metadata is kept too
+func checkAnimation(width int, height int, orientation int, rule config.UploadConf) error {
+	if rule.MaxWidth > 0 && rule.MaxHeight > 0 && (width > rule.MaxWidth || height > rule.MaxHeight) {
+		return fmt.Errorf("%w: animation %dx%d doesn't fit into %dx%d", errImageTooBig, width, height,
+			rule.MaxWidth, rule.MaxHeight)
+	}
+	if orientation > 1 && !rule.KeepOrientation {
+		return fmt.Errorf("%w: animation with orientation %d", errUnsupportedFormat, orientation)
+	}
+	return nil
+}
+
+func exportImage(image *vips.Image, format config.OutputFormat, quality int) ([]byte, error) {
+	switch format {
+	case config.OutputTypeWebp:
+		return image.ExportWebp(quality)
+	case config.OutputTypeAvif:
+		return image.ExportAvif(quality)
+	case config.OutputTypePng:
+		return image.ExportPng()
+	default:
+		// jpeg has no alpha channel, and transparent areas would become black
+		if err := image.Flatten(vips.Color{R: 255, G: 255, B: 255}); err != nil {
+			return nil, err
+		}
+		return image.ExportJpeg(quality)
 	}
 }
 
@@ -55,20 +166,194 @@ func UploadHandler(w http.ResponseWriter, r *http.Request) (int, error) {
 
 	IncUploaderRequests()
 
+	async := r.URL.Query().Get("async") == "1"
+
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		if async {
+			return 400, errors.New("multipart form can't be uploaded asynchronously")
+		}
+		return uploadMultipart(w, r)
+	}
+
+	key := r.URL.Query().Get("key")
+	presets, err := requestedPresets(r.URL.Query().Get("presets"))
+	if err != nil {
+		return 400, err
+	}
+
+	if async {
+		return enqueueUpload(w, r, key, presets)
+	}
+
+	if err := uploadPool.acquire(r.Context()); err != nil {
+		return uploadPool.reject(w, err)
+	}
+	defer uploadPool.release()
+
+	ctx, cancel := processingContext(r.Context())
+	defer cancel()
+
+	upInfo, err := uploadPhoto(ctx, key, r.Body, presets)
+	if err != nil {
+		return processingError(ctx, err)
+	}
+
+	js, _ := json.Marshal(upInfo)
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(js)
+
+	Free()
+
+	return 200, nil
+}
+
+// multipartResult is UploadedInfo of one file of the form, or the error it failed with
+type multipartResult struct {
+	File  string `json:"file"`
+	Error string `json:"error,omitempty"`
+	*UploadedInfo
+}
+
+// uploadMultipart handles form with one or several files. Every "key" field sets the name of the next file in
+// the form (so it must precede the file), files without one get generated names. Files are processed one by one
+// while reading the form, failed file doesn't stop the rest. Response lists results of all files, with 207 status
+// if some of them failed. If all failed, nothing is saved, and the first error is returned as usual
+func uploadMultipart(w http.ResponseWriter, r *http.Request) (int, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return 400, err
+	}
+
+	var keys []string
+	if key := r.URL.Query().Get("key"); key != "" {
+		keys = append(keys, key)
+	}
+
+	presets, err := requestedPresets(r.URL.Query().Get("presets"))
+	if err != nil {
+		return 400, err
+	}
+
+	if err := uploadPool.acquire(r.Context()); err != nil {
+		return uploadPool.reject(w, err)
+	}
+	defer uploadPool.release()
+
+	ctx, cancel := processingContext(r.Context())
+	defer cancel()
+
+	var results []multipartResult
+	var firstErr error
+	saved := 0
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// Files saved before are still reported
+			err = fmt.Errorf("failed to read multipart form: %w", err)
+			if saved == 0 {
+				return 400, err
+			}
+			log.Printf("Error in multipart upload: %v", err)
+			results = append(results, multipartResult{Error: err.Error()})
+			break
+		}
+
+		if part.FileName() == "" {
+			if part.FormName() == "key" {
+				value, err := io.ReadAll(io.LimitReader(part, 1024))
+				if err != nil {
+					return 400, err
+				}
+				keys = append(keys, string(value))
+			}
+			continue
+		}
+
+		var key string
+		if len(keys) > 0 {
+			key, keys = keys[0], keys[1:]
+		}
+
+		upInfo, err := uploadPhoto(ctx, key, part, presets)
+		if err != nil {
+			err = fmt.Errorf("%s: %w", part.FileName(), err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			log.Printf("Error in multipart upload: %v", err)
+			results = append(results, multipartResult{File: part.FileName(), Error: err.Error()})
+			continue
+		}
+		saved++
+		results = append(results, multipartResult{File: part.FileName(), UploadedInfo: upInfo})
+	}
+
+	if len(results) == 0 {
+		return 400, errors.New("no files in multipart form")
+	}
+	if saved == 0 {
+		return processingError(ctx, firstErr)
+	}
+
+	js, _ := json.Marshal(results)
+
+	status := http.StatusOK
+	if saved < len(results) {
+		status = http.StatusMultiStatus
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(js)
+
+	Free()
+
+	return status, nil
+}
+
+// UploadURLHandler downloads image from url param and uploads it the same way as UploadHandler does
+func UploadURLHandler(w http.ResponseWriter, r *http.Request) (int, error) {
+
+	IncUploaderRequests()
+
 	q := r.URL.Query()
 	key := q.Get("key")
-	if key == "" {
-		key, _ = genUuid()
+	rawURL := q.Get("url")
+	if rawURL == "" {
+		return 400, errors.New("empty url arg")
+	}
+	presets, err := requestedPresets(q.Get("presets"))
+	if err != nil {
+		return 400, err
 	}
 
-	if err := queueSem.Acquire(r.Context(), 1); err != nil {
-		panic("maxSem")
+	// Downloaded file is held in memory, so fetching takes the slot too. Otherwise concurrent fetches are unlimited
+	if err := uploadPool.acquire(r.Context()); err != nil {
+		return uploadPool.reject(w, err)
 	}
-	defer queueSem.Release(1)
+	defer uploadPool.release()
 
-	upInfo, err := uploadPhoto(key, r.Body)
+	data, err := fetchImage(r.Context(), rawURL)
 	if err != nil {
-		return 500, err
+		switch {
+		case errors.Is(err, errFetchForbidden):
+			return 403, err
+		case errors.Is(err, errFetchFailed):
+			return 502, err
+		}
+		return processingError(r.Context(), err)
+	}
+
+	ctx, cancel := processingContext(r.Context())
+	defer cancel()
+
+	upInfo, err := uploadPhoto(ctx, key, bytes.NewReader(data), presets)
+	if err != nil {
+		return processingError(ctx, err)
 	}
 
 	js, _ := json.Marshal(upInfo)
@@ -87,27 +372,44 @@ func UploadFileHandler(w http.ResponseWriter, r *http.Request) (int, error) {
 
 	q := r.URL.Query()
 	key := q.Get("key")
-	if key == "" {
-		key, _ = genUuid()
-	}
-
 	filename := q.Get("filename")
+	presets, err := requestedPresets(q.Get("presets"))
+	if err != nil {
+		return 400, err
+	}
 
-	file, err := os.Open(filename)
-	defer file.Close()
+	path, err := allowedFile(filename)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return 404, err
+		}
+		return 403, err
+	}
 
+	// O_NOFOLLOW: the path is already resolved, so a symlink here means it was swapped after the check
+	file, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
 	if err != nil {
 		return 500, fmt.Errorf("failed to open file %v (%w)", filename, err)
 	}
+	defer file.Close()
 
-	if err := queueSem.Acquire(r.Context(), 1); err != nil {
-		panic("maxSem")
+	if err := uploadPool.acquire(r.Context()); err != nil {
+		return uploadPool.reject(w, err)
 	}
-	defer queueSem.Release(1)
+	defer uploadPool.release()
+
+	ctx, cancel := processingContext(r.Context())
+	defer cancel()
 
-	upInfo, err := uploadPhoto(key, file)
+	upInfo, err := uploadPhoto(ctx, key, file, presets)
 	if err != nil {
-		return 500, err
+		return processingError(ctx, err)
+	}
+
+	if current.Load().conf.UploadFile.DeleteAfterUpload {
+		if err := os.Remove(path); err != nil {
+			log.Printf("failed to delete uploaded file %s: %v", path, err)
+		}
 	}
 
 	js, _ := json.Marshal(upInfo)
@@ -120,14 +422,61 @@ func UploadFileHandler(w http.ResponseWriter, r *http.Request) (int, error) {
 	return 200, nil
 }
 
-func uploadPhoto(name string, r io.Reader) (*UploadedInfo, error) {
+// allowedFile resolves all symlinks in filename and checks the result is a regular file inside one of the
+// upload_file.allowed_dirs
+func allowedFile(filename string) (string, error) {
+	allowedDirs := current.Load().conf.UploadFile.AllowedDirs
+	if len(allowedDirs) == 0 {
+		return "", errors.New("upload_file is disabled: no allowed dirs")
+	}
+	if filename == "" {
+		return "", errors.New("empty filename arg")
+	}
+
+	path, err := filepath.Abs(filename)
+	if err != nil {
+		return "", err
+	}
+	path, err = filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("not a regular file: %s", filename)
+	}
+
+	for _, dir := range allowedDirs {
+		rel, err := filepath.Rel(dir, path)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("file is outside of allowed dirs: %s", filename)
+}
+
+// uploadPhoto processes and saves image. If name is empty, it's generated: random or derived from content hash,
+// depending on storage.key_hash setting. In the latter case already existing image isn't saved again.
+// Presets, both given and from the upload rule, are rendered into the output cache after saving
+func uploadPhoto(ctx context.Context, name string, r io.Reader, presets []string) (*UploadedInfo, error) {
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
 
+	canceler := vips.NewCanceler(ctx)
+	defer canceler.Close()
+
 	newImg := imgStorage.NewImage()
 	defer newImg.Close()
 
-	if _, err := newImg.ReadFrom(r); err != nil {
+	if _, err := newImg.ReadFrom(limitInput(r)); err != nil {
+		return nil, err
+	}
+
+	if err := checkInput(newImg.Data); err != nil {
 		return nil, err
 	}
 
@@ -136,32 +485,189 @@ func uploadPhoto(name string, r io.Reader) (*UploadedInfo, error) {
 	defer vips.Cleanup()
 
 	if err := image.LoadFromBuffer(newImg.Data); err != nil {
+		return nil, fmt.Errorf("%w: %v", errBrokenInput, err)
+	}
+	canceler.Attach(&image)
+
+	if err := checkDimensions(&image); err != nil {
 		return nil, err
 	}
 
-	if image.Width()*image.Height() > 16000*16000 {
-		return nil, fmt.Errorf("input image is too big %vx%v", image.Width(), image.Height())
+	loader, _ := vips.FindLoader(newImg.Data)
+	upInfo := &UploadedInfo{
+		Name:           name,
+		OriginalFormat: loader,
+		OriginalWidth:  image.Width(),
+		OriginalHeight: image.Height(),
+		Orientation:    image.Orientation(),
+	}
+
+	rule := uploadRule(name)
+
+	format := rule.Format
+	if format == config.OutputTypeOriginal {
+		format = originalFormat(loader, image.Pages())
 	}
 
-	if err := preprocess(&image); err != nil {
+	var imageBytes []byte
+	var err error
+	if format == config.OutputTypeOriginal {
+		if err := checkAnimation(image.Width(), image.Height(), image.Orientation(), rule); err != nil {
+			return nil, err
+		}
+		imageBytes = newImg.Data
+		format = config.OutputFormat(loader)
+	} else if imageBytes, err = convertUpload(&image, canceler, newImg.Data, rule, format); err != nil {
 		return nil, err
 	}
 
-	if err := image.Strip(); err != nil {
+	hash := sha256.Sum256(imageBytes)
+
+	upInfo.Width = image.Width()
+	upInfo.Height = image.Height()
+	upInfo.Format = format
+	upInfo.Size = len(imageBytes)
+	upInfo.Hash = hex.EncodeToString(hash[:])
+	upInfo.HasAlpha = image.HasAlpha()
+
+	if upInfo.BlurHash, upInfo.DominantColor, err = placeholder(imageBytes); err != nil {
+		return nil, fmt.Errorf("failed to make placeholder: %w", err)
+	}
+
+	if name == "" {
+		switch keyHash {
+		case config.KeyHashOriginal:
+			upInfo.Name = hashKey(newImg.Data)
+		case config.KeyHashOutput:
+			upInfo.Name = hashKey(imageBytes)
+		default:
+			upInfo.Name, _ = genUuid()
+		}
+
+		if keyHash != "" {
+			exists, err := imgStorage.Exists(ctx, upInfo.Name)
+			if err != nil {
+				return nil, err
+			}
+			if exists {
+				upInfo.Deduplicated = true
+				return upInfo, nil
+			}
+		}
+	}
+
+	if err := imgStorage.Upload(upInfo.Name, imageBytes); err != nil {
 		return nil, err
 	}
 
-	imageBytes, _ := image.ExportJpeg(95)
+	presets = append(slices.Clone(rule.Presets), presets...)
+	slices.Sort(presets)
+	upInfo.Derivatives = renderDerivatives(ctx, upInfo.Name, imageBytes, slices.Compact(presets))
+
+	return upInfo, nil
+}
+
+// requestedPresets parses comma separated list of presets from upload request
+func requestedPresets(value string) ([]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+	if !imgStorage.OutputCache() {
+		return nil, errors.New("presets are given, but output cache is disabled")
+	}
+
+	presets := strings.Split(value, ",")
+	for _, name := range presets {
+		if _, ok := current.Load().presets.Preset(name); !ok {
+			return nil, fmt.Errorf("unknown preset %s", name)
+		}
+	}
+	return presets, nil
+}
+
+// renderDerivatives puts resized versions of just uploaded image into the output cache, so the first page view
+// doesn't wait for all of them at once. Failures are only logged: the image itself is already saved.
+// Returns presets rendered in all output formats
+func renderDerivatives(ctx context.Context, path string, data []byte, presets []string) []string {
+	if len(presets) == 0 {
+		return nil
+	}
+	version, err := imgStorage.Version(ctx, path)
+	if err != nil {
+		log.Printf("failed to get version of %s, presets aren't rendered: %v", path, err)
+		return nil
+	}
+
+	st := current.Load()
+	var rendered []string
+
+	for _, name := range presets {
+		pms, ok := st.presets.Preset(name)
+		if !ok {
+			log.Printf("unknown preset %s for %s", name, path)
+			continue
+		}
+
+		done := true
+		for _, format := range outputFormats(&st.conf.Resizer) {
+			quality := exportQuality(pms, format, &st.conf.Resizer)
+			if err := renderDerivative(ctx, path, version, data, pms, format, quality); err != nil {
+				log.Printf("failed to render preset %s (%s) for %s: %v", name, format, path, err)
+				done = false
+			}
+		}
+		if done {
+			rendered = append(rendered, name)
+		}
+	}
+
+	return rendered
+}
+
+func renderDerivative(ctx context.Context, path string, version string, data []byte, pms params.Params,
+	format config.OutputFormat, quality int) error {
+	image := vips.Image{}
+	defer image.Close()
+
+	imageBytes, err := resizeImage(ctx, &image, data, pms, format, quality)
+	if err != nil {
+		return err
+	}
+	return imgStorage.SaveOutput(outputKey(path, version, pms, format, quality), imageBytes)
+}
+
+// convertUpload rotates, fits and strips uploaded image according to the rule, and saves it in format
+func convertUpload(image *vips.Image, canceler *vips.Canceler, data []byte, rule config.UploadConf, format config.OutputFormat) ([]byte, error) {
+	if !rule.KeepOrientation {
+		if err := autoRotate(image, data); err != nil {
+			return nil, err
+		}
+		canceler.Attach(image)
+	}
 
-	if err := imgStorage.Upload(name, imageBytes); err != nil {
+	if err := fitInto(image, rule.MaxWidth, rule.MaxHeight); err != nil {
 		return nil, err
 	}
 
-	return &UploadedInfo{
-		Name:   name,
-		Width:  image.Width(),
-		Height: image.Height(),
-	}, nil
+	if !rule.KeepMetadata {
+		if err := image.Strip(); err != nil {
+			return nil, err
+		}
+	}
+
+	quality := rule.Quality
+	if quality == 0 {
+		quality = defaultUploadQuality[format]
+	}
+
+	canceler.Attach(image)
+	return exportImage(image, format, quality)
+}
+
+// hashKey makes key of the same length as genUuid does
+func hashKey(data []byte) string {
+	hash := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(hash[:16])
 }
 
 func genUuid() (string, error) {
@@ -174,3 +680,16 @@ func genUuid() (string, error) {
 
 	return base64.RawURLEncoding.EncodeToString(uuid), nil
 }
+
+// isUuid checks id looks like generated by genUuid, so it's safe to use it in paths
+func isUuid(id string) bool {
+	if len(id) != 22 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
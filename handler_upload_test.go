@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/levmv/imgserv/config"
+)
+
+func TestOriginalFormat(t *testing.T) {
+	var tests = []struct {
+		loader string
+		pages  int
+		want   config.OutputFormat
+	}{
+		{"jpeg", 1, config.OutputTypeJpeg},
+		{"png", 1, config.OutputTypePng},
+		{"webp", 1, config.OutputTypeWebp},
+		{"webp", 3, config.OutputTypeOriginal},
+		{"gif", 1, config.OutputTypePng},
+		{"gif", 2, config.OutputTypeOriginal},
+		{"heif", 1, config.OutputTypeAvif},
+		{"tiff", 1, config.OutputTypeJpeg},
+	}
+
+	for _, tt := range tests {
+		if got := originalFormat(tt.loader, tt.pages); got != tt.want {
+			t.Errorf("%s with %d pages: got %s, want %s", tt.loader, tt.pages, got, tt.want)
+		}
+	}
+}
+
+func TestCheckAnimation(t *testing.T) {
+	rule := config.UploadConf{MaxWidth: 100, MaxHeight: 100}
+
+	var tests = []struct {
+		width, height, orientation int
+		rule                       config.UploadConf
+		wantErr                    error
+	}{
+		{100, 50, 1, rule, nil},
+		{101, 50, 1, rule, errImageTooBig},
+		{50, 101, 0, rule, errImageTooBig},
+		{5000, 5000, 1, config.UploadConf{}, nil},
+		{50, 50, 6, rule, errUnsupportedFormat},
+		{50, 50, 6, config.UploadConf{KeepOrientation: true}, nil},
+	}
+
+	for _, tt := range tests {
+		err := checkAnimation(tt.width, tt.height, tt.orientation, tt.rule)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%dx%d, orientation %d, %+v: got %v, want %v", tt.width, tt.height, tt.orientation, tt.rule,
+				err, tt.wantErr)
+		}
+	}
+}
+
+func TestAllowedFile(t *testing.T) {
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"data/sub", "data2", "outside"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"data/sub/a.jpg", "data2/b.jpg", "outside/c.jpg"} {
+		if err := os.WriteFile(filepath.Join(root, file), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"data/escape.jpg": "../outside/c.jpg",
+		"data/inner.jpg":  "sub/a.jpg",
+		"data/sibling":    "../data2",
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	current.Store(&settings{conf: &config.Config{UploadFile: config.UploadFileConf{AllowedDirs: []string{filepath.Join(root, "data")}}}})
+
+	var tests = []struct {
+		file string
+		ok   bool
+	}{
+		{"data/sub/a.jpg", true},
+		{"data/sub/../sub/a.jpg", true},
+		{"data/inner.jpg", true},
+		{"data/../data2/b.jpg", false},
+		{"data/sub/../../outside/c.jpg", false},
+		{"data2/b.jpg", false},
+		{"data/escape.jpg", false},
+		{"data/sibling/b.jpg", false},
+		{"data/sub", false},
+		{"data/missing.jpg", false},
+	}
+
+	for _, tt := range tests {
+		path, err := allowedFile(filepath.Join(root, tt.file))
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got %s, %v", tt.file, path, err)
+		}
+	}
+
+	// filepath.Join cleans the path, so traversal is checked on raw string as well
+	if _, err := allowedFile(root + "/data/../outside/c.jpg"); err == nil {
+		t.Error("traversal by raw path is allowed")
+	}
+}
+
+func TestUploadRule(t *testing.T) {
+	initUpload(config.StorageConf{Upload: []config.UploadConf{
+		{Prefix: "a", Quality: 1},
+		{Prefix: "avatars/", Quality: 2},
+		{Prefix: "", Quality: 3},
+	}})
+	defer initUpload(config.StorageConf{})
+
+	var tests = []struct {
+		key     string
+		quality int
+	}{
+		{"avatars/1.jpg", 2},
+		{"a1.jpg", 1},
+		{"photos/1.jpg", 3},
+		{"", 3}, // generated key, it could start with "a" as well
+	}
+
+	for _, tt := range tests {
+		if got := uploadRule(tt.key).Quality; got != tt.quality {
+			t.Errorf("%q: got rule with quality %d, want %d", tt.key, got, tt.quality)
+		}
+	}
+}
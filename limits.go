@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/levmv/imgserv/vips"
+)
+
+var (
+	errInputTooLarge     = errors.New("input file is too large")
+	errUnsupportedFormat = errors.New("unsupported input format")
+	errImageTooBig       = errors.New("input image is too big")
+	errBrokenInput       = errors.New("broken input image")
+)
+
+// isInputError tells the input itself is bad, so there is no use in trying it again
+func isInputError(err error) bool {
+	return errors.Is(err, errInputTooLarge) || errors.Is(err, errUnsupportedFormat) ||
+		errors.Is(err, errImageTooBig) || errors.Is(err, errBrokenInput)
+}
+
+// limitInput stops reading right after the size limit, so checkInput can notice oversize without reading it all
+func limitInput(r io.Reader) io.Reader {
+	maxSize := current.Load().conf.Limits.MaxFileSize
+	if maxSize <= 0 {
+		return r
+	}
+	return io.LimitReader(r, maxSize+1)
+}
+
+// checkInput validates raw file before decoding: its size and format detected by magic bytes
+func checkInput(data []byte) error {
+	limits := current.Load().conf.Limits
+
+	if limits.MaxFileSize > 0 && int64(len(data)) > limits.MaxFileSize {
+		return fmt.Errorf("%w: more than %d bytes", errInputTooLarge, limits.MaxFileSize)
+	}
+
+	if len(limits.AllowedFormats) == 0 {
+		return nil
+	}
+
+	format, err := vips.FindLoader(data)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errUnsupportedFormat, err)
+	}
+	if !slices.Contains(limits.AllowedFormats, format) {
+		return fmt.Errorf("%w: %s", errUnsupportedFormat, format)
+	}
+	return nil
+}
+
+// checkDimensions validates image size from header. Must be called right after loading, as vips loads lazily
+// and nothing is decoded yet
+func checkDimensions(image *vips.Image) error {
+	width, height := image.Width(), image.Height()
+	limits := current.Load().conf.Limits
+
+	if (limits.MaxPixels > 0 && width*height > limits.MaxPixels) ||
+		(limits.MaxWidth > 0 && width > limits.MaxWidth) ||
+		(limits.MaxHeight > 0 && height > limits.MaxHeight) {
+		return fmt.Errorf("%w: %vx%v", errImageTooBig, width, height)
+	}
+	return nil
+}
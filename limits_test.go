@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/levmv/imgserv/config"
+)
+
+func TestCheckInput(t *testing.T) {
+	defaultFormats := []string{"jpeg", "png", "webp", "gif", "heif"}
+
+	var tests = []struct {
+		file    string
+		limits  config.LimitsConf
+		wantErr error
+	}{
+		{"header.jpg", config.LimitsConf{AllowedFormats: defaultFormats}, nil},
+		{"pixel.png", config.LimitsConf{AllowedFormats: defaultFormats}, nil},
+		{"header.webp", config.LimitsConf{AllowedFormats: defaultFormats}, nil},
+		{"two-frames.gif", config.LimitsConf{AllowedFormats: defaultFormats}, nil},
+		{"header.jpg", config.LimitsConf{AllowedFormats: []string{"png"}}, errUnsupportedFormat},
+		{"pixel.png", config.LimitsConf{MaxFileSize: 10}, errInputTooLarge},
+		{"pixel.png", config.LimitsConf{}, nil},
+	}
+
+	for _, tt := range tests {
+		data, err := os.ReadFile("testdata/" + tt.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		current.Store(&settings{conf: &config.Config{Limits: tt.limits}})
+
+		err = checkInput(data)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s with %+v: got %v, want %v", tt.file, tt.limits, err, tt.wantErr)
+		}
+	}
+
+	current.Store(&settings{conf: &config.Config{Limits: config.LimitsConf{AllowedFormats: defaultFormats}}})
+	if err := checkInput([]byte("<html></html>")); !errors.Is(err, errUnsupportedFormat) {
+		t.Errorf("html: got %v", err)
+	}
+}
+
+func TestIsInputError(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var tests = []struct {
+		err        error
+		ctx        context.Context
+		inputError bool
+		status     int
+	}{
+		{fmt.Errorf("%w: more than 10 bytes", errInputTooLarge), context.Background(), true, 413},
+		{fmt.Errorf("%w: bmp", errUnsupportedFormat), context.Background(), true, 415},
+		{fmt.Errorf("%w: not a jpeg", errBrokenInput), context.Background(), true, 422},
+		{errors.New("read interrupted"), canceled, false, 499},
+		{errors.New("s3 is down"), context.Background(), false, 500},
+	}
+
+	for _, tt := range tests {
+		if got := isInputError(tt.err); got != tt.inputError {
+			t.Errorf("%v: input error %v, want %v", tt.err, got, tt.inputError)
+		}
+		if status, _ := processingError(tt.ctx, tt.err); status != tt.status {
+			t.Errorf("%v: status %d, want %d", tt.err, status, tt.status)
+		}
+	}
+}
@@ -11,7 +11,6 @@ import (
 	"syscall"
 
 	"github.com/levmv/imgserv/config"
-	"github.com/levmv/imgserv/params"
 	"github.com/levmv/imgserv/storage"
 	"github.com/levmv/imgserv/vips"
 	"golang.org/x/sync/semaphore"
@@ -23,44 +22,38 @@ const help = `usage: imgserv <action>
 actions:
   server -config=<path to config.json>
   stat [-config=<path to config.json>]
+  config check [-config=<path to config.json>]
+  sign [-config=<path to config.json>] <url>
   version`
 
 var (
 	maxSem     *semaphore.Weighted
-	queueSem   *semaphore.Weighted
-	sign       UrlSignature
+	resizePool *pool
+	sharePool  *pool
+	uploadPool *pool
 	imgStorage *storage.Cached
-	cfg        *config.Config
 )
 
 func run(cfgPath string) error {
 
-	var err error
-
-	cfg, err = config.Parse(cfgPath)
+	conf, err := config.Parse(cfgPath)
 	if err != nil {
 		log.Fatal(err)
 	}
+	cfgFile = cfgPath
 
-	if cfg.Resizer.Presets != nil {
-		if err = params.InitPresets(string(cfg.Resizer.Presets)); err != nil {
-			log.Fatal(err)
-		}
-	}
-	if cfg.Server.MemoryLimit > 0 {
-		debug.SetMemoryLimit(cfg.Server.MemoryLimit)
+	if conf.Server.MemoryLimit > 0 {
+		debug.SetMemoryLimit(conf.Server.MemoryLimit)
 	}
 
-	if cfg.Server.LogFile != "" {
-		file, err := os.OpenFile(cfg.Server.LogFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+	if conf.Server.LogFile != "" {
+		file, err := os.OpenFile(conf.Server.LogFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
 		if err != nil {
 			log.Fatal(err)
 		}
 		log.SetOutput(file)
 	}
 
-	sign = NewUrlSignature(cfg.Resizer.SignatureMethod, cfg.Resizer.SignatureSecret)
-
 	if err = vips.Init(nil); err != nil {
 		log.Fatal(err)
 	}
@@ -71,19 +64,38 @@ func run(cfgPath string) error {
 
 	ctx, cancel := context.WithCancel(context.Background())
 
-	imgStorage, err = storage.NewCached(cfg.Storage)
+	imgStorage, err = storage.NewCached(conf.Storage)
 	if err != nil {
 		log.Fatalf("Fail to init storage: %v", err)
 	}
 
-	initUpload(cfg.Storage)
-	if cfg.Sharer != nil {
-		if err = initSharer(ctx, cfg.Sharer); err != nil {
-			log.Fatalf("Fail to init sharer: %v", err)
-		}
+	// Settings are needed by workers started below, and sharer needs storage
+	st, err := newSettings(ctx, conf)
+	if err != nil {
+		log.Fatalf("Fail to init settings: %v", err)
+	}
+	setSettings(st)
+
+	initUpload(conf.Storage)
+	initFetcher(conf.Fetcher)
+	if err = initTus(conf.Tus); err != nil {
+		log.Fatalf("Fail to init tus: %v", err)
 	}
+	if err = initJobs(ctx, conf.Async); err != nil {
+		log.Fatalf("Fail to init async uploads: %v", err)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := reloadConfig(ctx); err != nil {
+				log.Printf("Fail to reload config: %v", err)
+			}
+		}
+	}()
 
-	startServer(cancel, cfg.Server)
+	startServer(cancel, conf.Server)
 
 	select {
 	case <-ctx.Done():
@@ -118,8 +130,40 @@ func main() {
 		if err := showStats(configArg); err != nil {
 			log.Fatal(err)
 		}
+	case "config":
+		if len(os.Args) < 3 || os.Args[2] != "check" {
+			fmt.Println("expected 'config check'")
+			os.Exit(1)
+		}
+		serverCmd.Parse(os.Args[3:])
+		errs := checkConfig(configArg)
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		if len(errs) > 0 {
+			os.Exit(1)
+		}
+		fmt.Println("config is ok")
+	case "sign":
+		serverCmd.Parse(os.Args[2:])
+		if serverCmd.NArg() != 1 {
+			fmt.Println("expected 'sign <url>'")
+			os.Exit(1)
+		}
+		conf, err := config.Parse(configArg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if conf.Resizer.SignatureSecret == "" {
+			log.Fatal("resizer.signature_secret is empty, nothing to sign with")
+		}
+		signed, err := NewUrlSignature(conf.Resizer.SignatureMethod, conf.Resizer.SignatureSecret).SignUrl(serverCmd.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(signed)
 	default:
-		fmt.Println("expected 'server', `stat` or 'version'")
+		fmt.Println("expected 'server', `stat`, `config check`, `sign` or 'version'")
 		os.Exit(1)
 	}
 }
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/levmv/imgserv/vips"
+)
+
+func TestMain(m *testing.M) {
+	if err := vips.Init(nil); err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	vips.Shutdown()
+	os.Exit(code)
+}
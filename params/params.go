@@ -7,6 +7,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync/atomic"
 
 	"github.com/levmv/imgserv/vips"
 )
@@ -75,26 +76,69 @@ func defaultParams() Params {
 	return params
 }
 
-var presets map[string]Params
+// Presets are named params, used in urls as "_name"
+type Presets map[string]Params
+
+// presets are used by package level Parse. Server keeps its own Presets with the rest of reloadable settings
+var presets atomic.Pointer[Presets]
 
 // InitPresets parse presets json config and save info to use when parsing urls
 func InitPresets(strPresets string) error {
+	parsed, err := ParsePresets(strPresets)
+	if err != nil {
+		return err
+	}
+	SetPresets(parsed)
+	return nil
+}
+
+// ParsePresets parse presets json config without using them yet, see SetPresets
+func ParsePresets(strPresets string) (Presets, error) {
 	var tmp map[string]json.RawMessage
 	if err := json.Unmarshal([]byte(strPresets), &tmp); err != nil {
-		return fmt.Errorf("can't parse presets (%w)", err)
+		return nil, fmt.Errorf("can't parse presets (%w)", err)
 	}
-	presets = make(map[string]Params)
+	parsed := make(Presets)
 	for name, preset := range tmp {
 		p := defaultParams()
 		if err := json.Unmarshal([]byte(preset), &p); err != nil {
-			return err
+			return nil, err
 		}
-		presets[name] = p
+		parsed[name] = p
+	}
+	return parsed, nil
+}
+
+// SetPresets replaces presets used when parsing urls
+func SetPresets(parsed Presets) {
+	presets.Store(&parsed)
+}
+
+func currentPresets() Presets {
+	if current := presets.Load(); current != nil {
+		return *current
 	}
 	return nil
 }
 
+// Preset returns params of the named preset, the same Parse gives for "_name"
+func Preset(name string) (Params, bool) {
+	return currentPresets().Preset(name)
+}
+
+// Preset returns params of the named preset, the same Parse gives for "_name"
+func (ps Presets) Preset(name string) (Params, bool) {
+	params, exist := ps[name]
+	return params, exist
+}
+
+// Parse parses url with presets set by SetPresets
 func Parse(inputQuery string) (string, Params, error) {
+	return currentPresets().Parse(inputQuery)
+}
+
+// Parse parses url, "_name" params are looked up in ps
+func (ps Presets) Parse(inputQuery string) (string, Params, error) {
 
 	params := defaultParams()
 	var exist bool
@@ -200,7 +244,7 @@ func Parse(inputQuery string) (string, Params, error) {
 		case "p":
 			params.PixelRatio, _ = strconv.ParseFloat(value, 64)
 		case "_":
-			params, exist = presets[value]
+			params, exist = ps.Preset(value)
 			if !exist {
 				return path, params, errors.New("unknown preset " + value)
 			}
@@ -63,3 +63,42 @@ func TestParseParams(t *testing.T) {
 	}
 
 }
+
+func TestSetPresets(t *testing.T) {
+	if err := InitPresets(`{"sq":{"resize": true, "mode":"crop", "width":100,"height":100}}`); err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ParsePresets(`{"sq":{"resize": true, "mode":"crop", "width":200,"height":200},"wide":{"width":800}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, params, _ := Parse("_sq/foo"); params.Width != 100 {
+		t.Errorf("parsed presets are used before SetPresets: width %d", params.Width)
+	}
+
+	SetPresets(parsed)
+	if _, params, err := Parse("_sq/foo"); err != nil || params.Width != 200 {
+		t.Errorf("swapped preset: got width %d, %v", params.Width, err)
+	}
+	if _, params, err := Parse("_wide/foo"); err != nil || params.Width != 800 {
+		t.Errorf("added preset: got width %d, %v", params.Width, err)
+	}
+
+	for _, broken := range []string{`{"sq":`, `{"sq":{"width":"wide"}}`, `[]`} {
+		if _, err := ParsePresets(broken); err == nil {
+			t.Errorf("no error for %s", broken)
+		}
+		if err := InitPresets(broken); err == nil {
+			t.Errorf("no error for %s", broken)
+		}
+		if _, params, err := Parse("_sq/foo"); err != nil || params.Width != 200 {
+			t.Errorf("after failed %s: got width %d, %v", broken, params.Width, err)
+		}
+	}
+
+	SetPresets(map[string]Params{})
+	if _, _, err := Parse("_sq/foo"); err == nil {
+		t.Error("removed preset is still parsed")
+	}
+}
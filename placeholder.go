@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/levmv/imgserv/blurhash"
+	"github.com/levmv/imgserv/vips"
+)
+
+// Placeholder is made from a tiny copy of the image: that's enough for both blurhash and dominant colour
+const placeholderSize = 32
+
+func placeholder(imageBytes []byte) (string, string, error) {
+	thumb := vips.Image{}
+	defer thumb.Close()
+
+	if err := thumb.ThumbnailFromBuffer(imageBytes, placeholderSize, placeholderSize, vips.InterestingNone, vips.SizeDown); err != nil {
+		return "", "", err
+	}
+
+	pixels, err := thumb.RGBPixels()
+	if err != nil {
+		return "", "", err
+	}
+
+	xComponents, yComponents := 4, 3
+	if thumb.Height() > thumb.Width() {
+		xComponents, yComponents = 3, 4
+	}
+
+	hash, err := blurhash.Encode(xComponents, yComponents, thumb.Width(), thumb.Height(), pixels)
+	if err != nil {
+		return "", "", err
+	}
+
+	return hash, dominantColor(pixels), nil
+}
+
+// dominantColor finds the most common colour, with channels rounded to 4 bits, and returns average of the pixels
+// having it. It works better than plain average, which tends to be muddy grey
+func dominantColor(rgb []byte) string {
+	var counts [4096]int
+	var sums [4096][3]int
+
+	best := 0
+	for i := 0; i+2 < len(rgb); i += 3 {
+		bucket := int(rgb[i]>>4)<<8 | int(rgb[i+1]>>4)<<4 | int(rgb[i+2]>>4)
+		counts[bucket]++
+		sums[bucket][0] += int(rgb[i])
+		sums[bucket][1] += int(rgb[i+1])
+		sums[bucket][2] += int(rgb[i+2])
+		if counts[bucket] > counts[best] {
+			best = bucket
+		}
+	}
+
+	if counts[best] == 0 {
+		return ""
+	}
+
+	n := counts[best]
+	return fmt.Sprintf("#%02x%02x%02x", sums[best][0]/n, sums[best][1]/n, sums[best][2]/n)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/levmv/imgserv/config"
+	"golang.org/x/sync/semaphore"
+)
+
+var (
+	errQueueFull    = errors.New("queue is full")
+	errQueueTimeout = errors.New("queue wait timeout")
+)
+
+// pool limits concurrency of one kind of work, so heavy uploads don't take slots of thumbnails. Waiting requests
+// get slots in order of arrival (semaphore.Weighted is FIFO), no more than maxQueue of them may wait, and
+// none longer than maxWait
+type pool struct {
+	sem      *semaphore.Weighted
+	maxQueue int64
+	maxWait  time.Duration
+	queued   atomic.Int64
+}
+
+func newPool(conf config.PoolConf) *pool {
+	return &pool{
+		sem:      semaphore.NewWeighted(int64(conf.Concurrency)),
+		maxQueue: int64(conf.MaxQueue),
+		maxWait:  time.Duration(conf.MaxWait) * time.Second,
+	}
+}
+
+// acquire takes a slot, waiting for it in queue. Zero maxQueue and maxWait mean no limit
+func (p *pool) acquire(ctx context.Context) error {
+	// TryAcquire fails while somebody is waiting, so it can't jump the queue
+	if p.sem.TryAcquire(1) {
+		return nil
+	}
+
+	if queued := p.queued.Add(1); p.maxQueue > 0 && queued > p.maxQueue {
+		p.queued.Add(-1)
+		IncRejectedRequests()
+		return errQueueFull
+	}
+	defer p.queued.Add(-1)
+
+	waitCtx := ctx
+	if p.maxWait > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, p.maxWait)
+		defer cancel()
+	}
+
+	if err := p.sem.Acquire(waitCtx, 1); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		IncRejectedRequests()
+		return errQueueTimeout
+	}
+	return nil
+}
+
+// wait takes a slot ignoring queue limits. It's for callers which are limited by themselves, like upload workers
+func (p *pool) wait(ctx context.Context) error {
+	return p.sem.Acquire(ctx, 1)
+}
+
+func (p *pool) release() {
+	p.sem.Release(1)
+}
+
+// depth returns number of requests waiting for a slot
+func (p *pool) depth() int64 {
+	return p.queued.Load()
+}
+
+// reject picks response for failed acquire. Client is asked to come back after about the time of full queue wait
+func (p *pool) reject(w http.ResponseWriter, err error) (int, error) {
+	if errors.Is(err, errQueueFull) || errors.Is(err, errQueueTimeout) {
+		retryAfter := max(int(p.maxWait.Seconds()), 1)
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		return http.StatusServiceUnavailable, err
+	}
+	return 499, fmt.Errorf("request cancelled: %w", err)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/levmv/imgserv/config"
+)
+
+func TestPool(t *testing.T) {
+	var tests = []struct {
+		name       string
+		conf       config.PoolConf
+		busy       int // slots taken before
+		waiting    int // requests queued before
+		timeout    time.Duration
+		wantErr    error
+		status     int
+		retryAfter string
+	}{
+		{"free slot", config.PoolConf{Concurrency: 2}, 1, 0, 0, nil, 0, ""},
+		{"queue full", config.PoolConf{Concurrency: 1, MaxQueue: 1}, 1, 1, 0, errQueueFull, 503, "1"},
+		{"queue full with wait", config.PoolConf{Concurrency: 1, MaxQueue: 2, MaxWait: 3}, 1, 2, 0, errQueueFull, 503, "3"},
+		{"wait timeout", config.PoolConf{Concurrency: 1, MaxQueue: 2, MaxWait: 1}, 1, 1, 0, errQueueTimeout, 503, "1"},
+		{"cancelled", config.PoolConf{Concurrency: 1}, 1, 2, 50 * time.Millisecond, context.DeadlineExceeded, 499, ""},
+	}
+
+	for _, tt := range tests {
+		p := newPool(tt.conf)
+		for i := 0; i < tt.busy; i++ {
+			if err := p.acquire(context.Background()); err != nil {
+				t.Fatalf("%s: can't take slot: %v", tt.name, err)
+			}
+		}
+
+		waitCtx, stopWaiting := context.WithCancel(context.Background())
+		var wg sync.WaitGroup
+		for i := 0; i < tt.waiting; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if p.acquire(waitCtx) == nil {
+					p.release()
+				}
+			}()
+		}
+		for p.depth() < int64(tt.waiting) {
+			time.Sleep(time.Millisecond)
+		}
+
+		ctx := context.Background()
+		if tt.timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+			defer cancel()
+		}
+
+		err := p.acquire(ctx)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.wantErr)
+		}
+		if err != nil {
+			w := httptest.NewRecorder()
+			if status, _ := p.reject(w, err); status != tt.status {
+				t.Errorf("%s: status %d, want %d", tt.name, status, tt.status)
+			}
+			if got := w.Header().Get("Retry-After"); got != tt.retryAfter {
+				t.Errorf("%s: Retry-After %q, want %q", tt.name, got, tt.retryAfter)
+			}
+		}
+
+		stopWaiting()
+		wg.Wait()
+		if depth := p.depth(); depth != 0 {
+			t.Errorf("%s: %d queued after all left", tt.name, depth)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"reflect"
+	"sync"
+	"sync/atomic"
+
+	"github.com/levmv/imgserv/config"
+	"github.com/levmv/imgserv/params"
+)
+
+// Config is read again on SIGHUP or by /reload. Everything used per request is swapped atomically as one settings:
+// presets, resizer settings, signature, limits, upload_file and sharer. Listening, pools, storage and the rest of
+// workers are set up once on start, changes of them are only logged and need restart
+
+// settings are made from one config. Request takes them once, so it never mixes old and new ones
+type settings struct {
+	conf    *config.Config
+	sign    UrlSignature
+	presets params.Presets
+	sharer  *sharer // nil if disabled
+}
+
+var (
+	cfgFile  string
+	reloadMu sync.Mutex
+	current  atomic.Pointer[settings] // replaced by reloadConfig
+)
+
+// newSettings prepares everything reloadable. Sharer loads images, so it's the last what could fail
+func newSettings(ctx context.Context, conf *config.Config) (*settings, error) {
+	st := settings{
+		conf: conf,
+		sign: NewUrlSignature(conf.Resizer.SignatureMethod, conf.Resizer.SignatureSecret),
+	}
+
+	var err error
+	if conf.Resizer.Presets != nil {
+		if st.presets, err = params.ParsePresets(string(conf.Resizer.Presets)); err != nil {
+			return nil, err
+		}
+	}
+
+	if conf.Sharer != nil {
+		if st.sharer, err = newSharer(ctx, conf.Sharer); err != nil {
+			return nil, err
+		}
+	}
+	warnUnsignedShare(conf)
+
+	return &st, nil
+}
+
+// setSettings puts new settings in use and stops what's left from the old ones
+func setSettings(st *settings) {
+	if old := current.Swap(st); old != nil && old.sharer != nil {
+		old.sharer.stop()
+	}
+}
+
+func reloadConfig(ctx context.Context) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	conf, err := config.Parse(cfgFile)
+	if err != nil {
+		return err
+	}
+
+	st, err := newSettings(ctx, conf)
+	if err != nil {
+		return err
+	}
+
+	old := current.Load().conf
+	for name, changed := range map[string]bool{
+		"server":  !reflect.DeepEqual(old.Server, conf.Server),
+		"storage": !reflect.DeepEqual(old.Storage, conf.Storage),
+		"fetcher": !reflect.DeepEqual(old.Fetcher, conf.Fetcher),
+		"tus":     !reflect.DeepEqual(old.Tus, conf.Tus),
+		"async":   !reflect.DeepEqual(old.Async, conf.Async),
+	} {
+		if changed {
+			log.Printf("Config section %s is changed, restart to apply it", name)
+		}
+	}
+
+	setSettings(st)
+
+	log.Printf("Config %s reloaded", cfgFile)
+	return nil
+}
+
+// ReloadHandler reloads config by request. Error is returned in the body, so it's seen by whoever calls it.
+// The endpoint is public, so it's disabled without server.reload_secret, and the secret must be in X-Reload-Secret
+func ReloadHandler(w http.ResponseWriter, r *http.Request) (int, error) {
+	secret := current.Load().conf.Server.ReloadSecret
+	if secret == "" {
+		return 404, errors.New("reload by request is disabled: no server.reload_secret")
+	}
+	if r.Method != http.MethodPost {
+		return 405, errors.New("reload needs POST")
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Reload-Secret")), []byte(secret)) != 1 {
+		return 403, errors.New("wrong reload secret")
+	}
+
+	if err := reloadConfig(r.Context()); err != nil {
+		log.Printf("Fail to reload config: %v", err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return 422, nil
+	}
+
+	return 200, nil
+}
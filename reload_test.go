@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/levmv/imgserv/config"
+)
+
+func TestReloadHandlerSecret(t *testing.T) {
+	cfgFile = filepath.Join(t.TempDir(), "missing.json")
+
+	var tests = []struct {
+		name   string
+		secret string
+		method string
+		header string
+		status int
+	}{
+		{"disabled", "", http.MethodPost, "", 404},
+		{"disabled with header", "", http.MethodPost, "x", 404},
+		{"get", "secret", http.MethodGet, "secret", 405},
+		{"no header", "secret", http.MethodPost, "", 403},
+		{"wrong secret", "secret", http.MethodPost, "secre", 403},
+		{"reloaded", "secret", http.MethodPost, "secret", 422}, // config file is missing, but reload was tried
+	}
+
+	for _, tt := range tests {
+		current.Store(&settings{conf: &config.Config{Server: config.ServerConf{ReloadSecret: tt.secret}}})
+
+		r := httptest.NewRequest(tt.method, "/reload", nil)
+		if tt.header != "" {
+			r.Header.Set("X-Reload-Secret", tt.header)
+		}
+		if status, _ := ReloadHandler(httptest.NewRecorder(), r); status != tt.status {
+			t.Errorf("%s: got %d, want %d", tt.name, status, tt.status)
+		}
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	dir := t.TempDir()
+	credentials := filepath.Join(dir, "credentials")
+	if err := os.WriteFile(credentials, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	writeConfig := func(resizer string) {
+		text := `{"storage": {"bucket": "images", "credentials": "` + credentials + `"}, "resizer": ` + resizer + `}`
+		if err := os.WriteFile(cfgFile, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfgFile = filepath.Join(dir, "config.json")
+	old := &settings{conf: &config.Config{}}
+	current.Store(old)
+
+	writeConfig(`{"signature_method": "t3", "signature_secret": "new", "jpeg_q_correction": 5,
+		"presets": {"sq": {"resize": true, "width": 100, "height": 100}}}`)
+	if err := reloadConfig(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	st := current.Load()
+	if _, ok := st.presets.Preset("sq"); !ok || st.sign.Secret != "new" || st.conf.Resizer.JpegQCorrection != 5 {
+		t.Errorf("settings are not replaced together: %+v", st)
+	}
+
+	writeConfig(`{"signature_secret": "newer", "presets": {"sq": {"width": "wide"}}}`)
+	if err := reloadConfig(context.Background()); err == nil {
+		t.Error("broken presets are loaded")
+	}
+	if current.Load() != st {
+		t.Error("settings are changed by failed reload")
+	}
+}
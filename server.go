@@ -34,18 +34,51 @@ func (fn appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if status, err := fn(w, r); err != nil {
 		log.Printf("Error %d %v", status, err)
 		switch status {
-		case http.StatusNotFound:
-			http.Error(w, http.StatusText(http.StatusNotFound), status)
+		case http.StatusTooManyRequests, http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusMethodNotAllowed,
+			http.StatusConflict, http.StatusPreconditionFailed, http.StatusRequestEntityTooLarge,
+			http.StatusUnsupportedMediaType, http.StatusUnprocessableEntity, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			http.Error(w, http.StatusText(status), status)
 		default:
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		}
 	}
 }
 
+// processingContext limits time of loading and processing an image by configured timeout
+func processingContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := current.Load().conf.Server.ProcessingTimeout
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+}
+
+// processingError picks response status for the error happened during processing. If the context is done, vips
+// was most likely killed by Canceler, and it's not an error of the image itself
+func processingError(ctx context.Context, err error) (int, error) {
+	switch {
+	case errors.Is(err, errInputTooLarge):
+		return http.StatusRequestEntityTooLarge, err
+	case errors.Is(err, errUnsupportedFormat):
+		return http.StatusUnsupportedMediaType, err
+	case errors.Is(err, errImageTooBig), errors.Is(err, errBrokenInput):
+		return http.StatusUnprocessableEntity, err
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		IncTimedOutRequests()
+		return http.StatusGatewayTimeout, fmt.Errorf("processing timeout: %w", err)
+	case errors.Is(ctx.Err(), context.Canceled):
+		return 499, fmt.Errorf("request cancelled: %w", err)
+	}
+	return 500, err
+}
+
 func startServer(cancel context.CancelFunc, conf config.ServerConf) {
 
 	maxSem = semaphore.NewWeighted(int64(conf.MaxClients))
-	queueSem = semaphore.NewWeighted(int64(conf.Concurrency))
+	resizePool = newPool(conf.Resize)
+	sharePool = newPool(conf.Share)
+	uploadPool = newPool(conf.Upload)
 
 	go func() {
 		ticker := time.NewTicker(time.Duration(conf.FreeMemoryInterval) * time.Second)
@@ -58,9 +91,15 @@ func startServer(cancel context.CancelFunc, conf config.ServerConf) {
 	http.Handle("/", appHandler(serveImg))
 	http.Handle("/share", appHandler(serveShareImg))
 	http.Handle("/upload", appHandler(UploadHandler))
+	http.Handle("/upload_url", appHandler(UploadURLHandler))
 	http.Handle("/upload_file", appHandler(UploadFileHandler))
+	http.Handle("/upload_status", appHandler(UploadStatusHandler))
+	http.Handle("/tus", appHandler(TusHandler))
+	http.Handle("/tus/", appHandler(TusHandler))
+	http.Handle("/info", appHandler(InfoHandler))
 	http.Handle("/delete", appHandler(DeleteHandler))
 	http.Handle("/stat", appHandler(serveStat))
+	http.Handle("/reload", appHandler(ReloadHandler))
 	http.HandleFunc("/favicon.ico", http.NotFound)
 
 	log.Printf("Starting server on %s", conf.BindTo)
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"crypto/hmac"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"net/url"
+	"slices"
 	"strings"
 )
 
@@ -62,3 +67,83 @@ func shortHash(str string, secret string, offset int, size int) string {
 	hash := md5.Sum([]byte(str + secret))
 	return base64.RawURLEncoding.EncodeToString(hash[offset : offset+size])
 }
+
+// VerifyQuery checks signature of urls with params in query, like /share. Signature is "s" param: HMAC-SHA256 of
+// the path and canonicalQuery. It doesn't depend on signature method. Without secret any query passes, config check
+// allows it only with sharer.allow_unsigned
+func (sig UrlSignature) VerifyQuery(path string, query url.Values) error {
+	if sig.Secret == "" {
+		return nil
+	}
+
+	signature := query.Get("s")
+	if signature == "" {
+		return errors.New("no signature")
+	}
+	if !hmac.Equal([]byte(signature), []byte(sig.SignQuery(path, query))) {
+		return fmt.Errorf("wrong signature for %s?%s", path, query.Encode())
+	}
+	return nil
+}
+
+// SignQuery makes signature for VerifyQuery, "s" param itself is ignored
+func (sig UrlSignature) SignQuery(path string, query url.Values) string {
+	mac := hmac.New(sha256.New, []byte(sig.Secret))
+	mac.Write([]byte(path + "?" + canonicalQuery(query)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// canonicalQuery is the signed form of query: params except "s" sorted by name, with names and values encoded by
+// RFC 3986 (the same as PHP rawurlencode), so clients don't depend on the way their url library encodes spaces or "~"
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		if name != "s" {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		for _, value := range query[name] {
+			if b.Len() > 0 {
+				b.WriteByte('&')
+			}
+			b.WriteString(escapeRFC3986(name))
+			b.WriteByte('=')
+			b.WriteString(escapeRFC3986(value))
+		}
+	}
+	return b.String()
+}
+
+// escapeRFC3986 percent-encodes everything but unreserved characters
+func escapeRFC3986(s string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '.' || c == '_' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			b.WriteByte('%')
+			b.WriteByte(hex[c>>4])
+			b.WriteByte(hex[c&15])
+		}
+	}
+	return b.String()
+}
+
+// SignUrl adds "s" param to url for VerifyQuery. Params may be in any order, the signature doesn't depend on it
+func (sig UrlSignature) SignUrl(rawUrl string) (string, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Set("s", sig.SignQuery(u.Path, query))
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestSignQuery(t *testing.T) {
+	sig := NewUrlSignature("", "secret")
+
+	signed, err := sig.SignUrl("/share?text=Hello+world&key=a%2Fb.jpg&template=card")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(signed)
+	s := u.Query().Get("s")
+
+	tests := []struct {
+		name  string
+		query string
+		ok    bool
+	}{
+		{"signed", u.RawQuery, true},
+		{"reordered", "template=card&s=" + s + "&key=a%2Fb.jpg&text=Hello%20world", true},
+		{"tampered text", "text=Hello+world!&key=a%2Fb.jpg&template=card&s=" + s, false},
+		{"added param", "text=Hello+world&key=a%2Fb.jpg&template=card&logo=x&s=" + s, false},
+		{"no signature", "text=Hello+world&key=a%2Fb.jpg&template=card", false},
+	}
+	for _, tt := range tests {
+		query, _ := url.ParseQuery(tt.query)
+		err := sig.VerifyQuery("/share", query)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got error %v", tt.name, err)
+		}
+	}
+
+	query, _ := url.ParseQuery(u.RawQuery)
+	if err := sig.VerifyQuery("/other", query); err == nil {
+		t.Error("signature for another path is accepted")
+	}
+	if err := NewUrlSignature("", "other").VerifyQuery("/share", query); err == nil {
+		t.Error("signature with another secret is accepted")
+	}
+}
+
+// Vector is made independently, the same way as README PHP example does: http_build_query with PHP_QUERY_RFC3986
+func TestSignQueryVector(t *testing.T) {
+	sig := NewUrlSignature("", "secret")
+
+	query := url.Values{
+		"title": {"Привет"},
+		"text":  {"Hello ~world!"},
+		"key":   {"a/b.jpg"},
+		"s":     {"ignored"},
+	}
+	const canonical = "key=a%2Fb.jpg&text=Hello%20~world%21&title=%D0%9F%D1%80%D0%B8%D0%B2%D0%B5%D1%82"
+	if got := canonicalQuery(query); got != canonical {
+		t.Errorf("canonical query: got %s, want %s", got, canonical)
+	}
+	if got := sig.SignQuery("/share", query); got != "fvxe24i8S9Z_scVPb9Wfag" {
+		t.Errorf("got signature %s", got)
+	}
+
+	// The same params encoded by Go and by RFC 1738 (space as "+", "~" as "%7E") are signed the same way
+	for _, raw := range []string{
+		"key=a%2Fb.jpg&text=Hello+~world%21&title=%D0%9F%D1%80%D0%B8%D0%B2%D0%B5%D1%82&s=fvxe24i8S9Z_scVPb9Wfag",
+		"title=%D0%9F%D1%80%D0%B8%D0%B2%D0%B5%D1%82&text=Hello+%7Eworld!&key=a/b.jpg&s=fvxe24i8S9Z_scVPb9Wfag",
+	} {
+		parsed, _ := url.ParseQuery(raw)
+		if err := sig.VerifyQuery("/share", parsed); err != nil {
+			t.Errorf("%s: %v", raw, err)
+		}
+	}
+}
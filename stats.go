@@ -19,6 +19,7 @@ var (
 	uploaderRequests   uint64
 	totalRequests      uint64
 	rejectedRequests   uint64
+	timedOutRequests   uint64
 	requestsInProgress int32
 )
 
@@ -42,6 +43,10 @@ func IncRejectedRequests() {
 	atomic.AddUint64(&rejectedRequests, 1)
 }
 
+func IncTimedOutRequests() {
+	atomic.AddUint64(&timedOutRequests, 1)
+}
+
 func IncRequestsInProgress() int32 {
 	return atomic.AddInt32(&requestsInProgress, 1)
 }
@@ -63,8 +68,13 @@ type stats struct {
 	Shares        uint64
 	Uploaded      uint64
 	Rejected      uint64
+	TimedOut      uint64
 	ReqInProgress int32
-	GoStat        struct {
+	Queued        struct {
+		Resize, Share, Upload int64
+		UploadJobs            int
+	}
+	GoStat struct {
 		LiveObjects uint64
 
 		GcPauseTotal,
@@ -87,9 +97,15 @@ func newStats() stats {
 		Shares:        sharerRequests,
 		Uploaded:      uploaderRequests,
 		Rejected:      rejectedRequests,
+		TimedOut:      atomic.LoadUint64(&timedOutRequests),
 		ReqInProgress: RequestsInProgress(),
 	}
 
+	curStats.Queued.Resize = resizePool.depth()
+	curStats.Queued.Share = sharePool.depth()
+	curStats.Queued.Upload = uploadPool.depth()
+	curStats.Queued.UploadJobs = len(jobs.queue)
+
 	curStats.GoStat.NumGoroutine = runtime.NumGoroutine()
 
 	var m runtime.MemStats
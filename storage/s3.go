@@ -6,7 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -45,7 +45,6 @@ func NewS3Storage(b string, credentials string) (S3Storage, error) {
 		config.WithEndpointResolverWithOptions(customResolver),
 	)
 	if err != nil {
-		log.Fatal(err)
 		return f, err
 	}
 
@@ -70,16 +69,59 @@ func (f *S3Storage) Open(ctx context.Context, path string) (io.ReadCloser, error
 	return r.Body, err
 }
 
-func (f *S3Storage) Save(path string, file io.Reader) error {
-	_, err := f.client.PutObject(context.TODO(), &s3.PutObjectInput{
+func (f *S3Storage) Exists(ctx context.Context, path string) (bool, error) {
+	_, err := f.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Key:    aws.String(path),
+		Bucket: aws.String(f.Bucket),
+	})
+	if err != nil {
+		var er *types.NotFound
+		if errors.As(err, &er) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Check makes sure the bucket is accessible with configured credentials
+func (f *S3Storage) Check(ctx context.Context) error {
+	_, err := f.client.HeadBucket(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(f.Bucket),
+	})
+	if err != nil {
+		return fmt.Errorf("bucket %v is not accessible: %w", f.Bucket, err)
+	}
+	return nil
+}
+
+// Save uploads file and returns its ETag
+func (f *S3Storage) Save(path string, file io.Reader) (string, error) {
+	out, err := f.client.PutObject(context.TODO(), &s3.PutObjectInput{
 		Bucket: aws.String(f.Bucket),
 		Key:    aws.String(path),
 		Body:   file,
 	})
 	if err != nil {
-		return fmt.Errorf("couldn't upload file %v to %v: %w", path, f.Bucket, err)
+		return "", fmt.Errorf("couldn't upload file %v to %v: %w", path, f.Bucket, err)
 	}
-	return nil
+	return strings.Trim(aws.ToString(out.ETag), `"`), nil
+}
+
+// ETag returns version of the file without reading it
+func (f *S3Storage) ETag(ctx context.Context, path string) (string, error) {
+	out, err := f.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Key:    aws.String(path),
+		Bucket: aws.String(f.Bucket),
+	})
+	if err != nil {
+		var er *types.NotFound
+		if errors.As(err, &er) {
+			return "", NotFoundError
+		}
+		return "", err
+	}
+	return strings.Trim(aws.ToString(out.ETag), `"`), nil
 }
 
 func (f *S3Storage) Delete(path string) error {
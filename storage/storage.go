@@ -23,6 +23,9 @@ type Cached struct {
 	s3       S3Storage
 	pool     *sync.Pool
 	basePath string
+
+	outputCache  string
+	outputPrefix string
 }
 
 func NewCached(conf config.StorageConf) (*Cached, error) {
@@ -37,8 +40,10 @@ func NewCached(conf config.StorageConf) (*Cached, error) {
 	}
 
 	cs := Cached{
-		s3:       st,
-		basePath: cachePath,
+		s3:           st,
+		basePath:     cachePath,
+		outputCache:  conf.OutputCache,
+		outputPrefix: conf.OutputPrefix,
 		pool: &sync.Pool{
 			New: func() interface{} {
 				return make([]byte, 1024)
@@ -73,6 +78,34 @@ func initCachePath(base string) (string, error) {
 	return base, nil
 }
 
+// SpoolDir returns directory for temporary files near the cache, so they could be moved to it cheaply
+func (cs *Cached) SpoolDir(name string) (string, error) {
+	dir := filepath.Join(cs.basePath, name)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return dir, fmt.Errorf("failed to create spool directory: %s (%w)", dir, err)
+	}
+	return dir, nil
+}
+
+// Check makes sure the cache directory is writable and the bucket is accessible
+func (cs *Cached) Check(ctx context.Context) error {
+	var errs []error
+
+	file, err := os.CreateTemp(cs.basePath, "check")
+	if err != nil {
+		errs = append(errs, fmt.Errorf("cache directory is not writable: %w", err))
+	} else {
+		file.Close()
+		_ = os.Remove(file.Name())
+	}
+
+	if err := cs.s3.Check(ctx); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
 func (cs *Cached) NewImage() SourceImage {
 	return SourceImage{
 		Data: cs.pool.Get().([]byte),
@@ -94,19 +127,133 @@ func (cs *Cached) LoadImage(ctx context.Context, path string) (SourceImage, erro
 	return si, nil
 }
 
+// LoadFresh reads the file from s3 bypassing the cache, and puts the new version into the cache
+func (cs *Cached) LoadFresh(ctx context.Context, path string) (SourceImage, error) {
+	si := cs.NewImage()
+
+	r, err := cs.s3.Open(ctx, path)
+	if err != nil {
+		return si, err
+	}
+	defer r.Close()
+
+	if _, err = si.ReadFrom(r); err != nil {
+		return si, err
+	}
+	if len(si.Data) == 0 {
+		return si, errors.New("empty input file")
+	}
+
+	return si, cs.cacheFile(path, si.Data)
+}
+
+// Exists trusts only positive cache, as the file could be uploaded through another node after we cached 404
+func (cs *Cached) Exists(ctx context.Context, path string) (bool, error) {
+	r, err := cs.getCached(path)
+	if r != nil {
+		r.Close()
+	}
+	if err == nil {
+		return true, nil
+	}
+	if !errors.Is(err, NotCached) && !errors.Is(err, NotFoundError) {
+		return false, err
+	}
+
+	return cs.s3.Exists(ctx, path)
+}
+
 func (cs *Cached) Upload(path string, contents []byte) error {
-	if err := cs.s3.Save(path, bytes.NewReader(contents)); err != nil {
+	etag, err := cs.s3.Save(path, bytes.NewReader(contents))
+	if err != nil {
 		return err
 	}
 	if err := cs.cacheFile(path, contents); err != nil {
 		// TODO: try to delete uploaded?
 		return err
 	}
-	return nil
+	return cs.cacheFile(path+".version", []byte(etag))
+}
+
+// Version returns ETag of the file, so things made from it could be told from the ones made from its previous
+// version. It's cached like the file itself and updated by Upload and Delete. Missing file is cached as "404" too,
+// and the negative cache of LoadImage is trusted, so requests for missing images don't reach s3 every time
+func (cs *Cached) Version(ctx context.Context, path string) (string, error) {
+	r, err := cs.getCached(path + ".version")
+	if r != nil {
+		defer r.Close()
+	}
+	if err == nil {
+		data, err := io.ReadAll(r)
+		return string(data), err
+	}
+	if !errors.Is(err, NotCached) {
+		return "", err
+	}
+
+	if r, err := cs.getCached(path); r != nil {
+		r.Close()
+		if errors.Is(err, NotFoundError) {
+			return "", err
+		}
+	}
+
+	etag, err := cs.s3.ETag(ctx, path)
+	if err != nil {
+		if errors.Is(err, NotFoundError) {
+			if cerr := cs.cacheFile(path+".version", []byte("404")); cerr != nil {
+				err = cerr
+			}
+		}
+		return "", err
+	}
+	return etag, cs.cacheFile(path+".version", []byte(etag))
+}
+
+// OutputCache tells whether processed images should be saved by SaveOutput
+func (cs *Cached) OutputCache() bool {
+	return cs.outputCache != ""
+}
+
+// LoadOutput returns processed image saved by SaveOutput. NotCached means it has to be made
+func (cs *Cached) LoadOutput(ctx context.Context, key string) (SourceImage, error) {
+	key = cs.outputPrefix + key
+
+	if cs.outputCache == config.OutputCacheS3 {
+		si, err := cs.LoadImage(ctx, key)
+		if errors.Is(err, NotFoundError) {
+			err = NotCached
+		}
+		return si, err
+	}
+
+	si := cs.NewImage()
+	r, err := cs.getCached(key)
+	if r != nil {
+		defer r.Close()
+	}
+	if err != nil {
+		return si, err
+	}
+	_, err = si.ReadFrom(r)
+	return si, err
+}
+
+func (cs *Cached) SaveOutput(key string, data []byte) error {
+	key = cs.outputPrefix + key
+
+	if cs.outputCache == config.OutputCacheS3 {
+		return cs.Upload(key, data)
+	}
+	return cs.cacheFile(key, data)
 }
 
 func (cs *Cached) UploadFile(path string, r io.Reader) error {
-	return cs.s3.Save(path, r)
+	etag, err := cs.s3.Save(path, r)
+	if err != nil {
+		return err
+	}
+	return cs.cacheFile(path+".version", []byte(etag))
 }
 
 func (cs *Cached) Delete(path string) error {
@@ -114,11 +261,13 @@ func (cs *Cached) Delete(path string) error {
 		return err
 	}
 
-	err := os.Remove(cs.hashName(path))
-	if err != nil && errors.Is(err, fs.ErrNotExist) {
-		err = nil
+	for _, name := range []string{path, path + ".version"} {
+		err := os.Remove(cs.hashName(name))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
 	}
-	return err
+	return nil
 }
 
 func (cs *Cached) readImage(ctx context.Context, path string, si *SourceImage) error {
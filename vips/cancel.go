@@ -0,0 +1,85 @@
+package vips
+
+/*
+#include "vips.h"
+*/
+import "C"
+
+import (
+	"context"
+	"sync"
+)
+
+// Canceler aborts evaluation of attached images once its context is done. Vips pipelines are lazy, so most
+// of the work happens during export, long after the operations were built.
+type Canceler struct {
+	mu     sync.Mutex
+	images []*C.VipsImage
+	killed bool
+	closed bool
+	stop   chan struct{}
+}
+
+func NewCanceler(ctx context.Context) *Canceler {
+	c := &Canceler{
+		stop: make(chan struct{}),
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.kill()
+		case <-c.stop:
+		}
+	}()
+
+	return c
+}
+
+// Attach keeps a reference to current state of img, so it could be killed even after img itself was swapped or closed
+func (c *Canceler) Attach(img *Image) {
+	if img.VipsImage == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return
+	}
+
+	C.image_ref(img.VipsImage)
+	c.images = append(c.images, img.VipsImage)
+
+	if c.killed {
+		C.image_kill(img.VipsImage)
+	}
+}
+
+func (c *Canceler) kill() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.killed = true
+	for _, im := range c.images {
+		C.image_kill(im)
+	}
+}
+
+// Close stops watching the context and releases attached images
+func (c *Canceler) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return
+	}
+	c.closed = true
+	close(c.stop)
+
+	for i := range c.images {
+		C.clear_image(&c.images[i])
+	}
+	c.images = nil
+}
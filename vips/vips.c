@@ -1,4 +1,5 @@
 #include "vips.h"
+#include <math.h>
 #include <string.h>
 
 void g_free_go(void **buf) {
@@ -14,6 +15,15 @@ void swap_and_clear(VipsImage **in, VipsImage *out) {
   *in = out;
 }
 
+void image_ref(VipsImage *in) {
+  g_object_ref(in);
+}
+
+// Safe to call from any thread: evaluation checks the flag and stops with an error
+void image_kill(VipsImage *in) {
+  vips_image_set_kill(in, TRUE);
+}
+
 
 int vips_initialize() {
     return VIPS_INIT("levmv_vips");
@@ -28,6 +38,10 @@ VipsImage* image_new_from_buffer(void *buf, size_t len) {
   return vips_image_new_from_buffer(buf, len, "", "access", VIPS_ACCESS_SEQUENTIAL, NULL);
 }
 
+VipsImage* image_new_from_buffer_random(void *buf, size_t len) {
+  return vips_image_new_from_buffer(buf, len, "", "access", VIPS_ACCESS_RANDOM, NULL);
+}
+
 int thumbnail_buffer(void *buf, size_t len, VipsImage **out, int width, int height, int crop, int size) {
     if (height == 0) {
         return vips_thumbnail_buffer(buf, len, out, width, "crop", crop, "size", size, NULL);
@@ -85,6 +99,60 @@ int webpsave(VipsImage *in, void **buf, size_t *len, int quality) {
 }
 
 
+int pngsave(VipsImage *in, void **buf, size_t *len) {
+    return vips_pngsave_buffer(
+        in, buf, len,
+        "compression", 6,
+        NULL
+    );
+}
+
+
+int avifsave(VipsImage *in, void **buf, size_t *len, int quality) {
+    return vips_heifsave_buffer(
+        in, buf, len,
+        "Q", quality,
+        "compression", VIPS_FOREIGN_HEIF_COMPRESSION_AV1,
+        NULL
+    );
+}
+
+
+// Raw 8-bit sRGB pixels without alpha: flattened on white
+int rgb_pixels(VipsImage *in, void **buf, size_t *len) {
+    VipsObject *base = (VipsObject *) vips_image_new();
+    VipsImage **t = (VipsImage **) vips_object_local_array(base, 4);
+    VipsArrayDouble *white = vips_array_double_newv(3, 255.0, 255.0, 255.0);
+    int result;
+
+    if (vips_colourspace(in, &t[0], VIPS_INTERPRETATION_sRGB, NULL))
+        result = 1;
+    else if (vips_image_hasalpha(t[0]))
+        result = vips_flatten(t[0], &t[1], "background", white, NULL);
+    else
+        result = vips_copy(t[0], &t[1], NULL);
+
+    if (!result)
+        result = vips_extract_band(t[1], &t[2], 0, "n", 3, NULL) ||
+            vips_cast(t[2], &t[3], VIPS_FORMAT_UCHAR, NULL);
+
+    if (!result) {
+        *buf = vips_image_write_to_memory(t[3], len);
+        if (*buf == NULL)
+            result = 1;
+    }
+
+    vips_area_unref(VIPS_AREA(white));
+    g_object_unref(base);
+    return result;
+}
+
+
+int has_alpha(VipsImage *in) {
+    return vips_image_hasalpha(in);
+}
+
+
 int embed_image(VipsImage *in, VipsImage **out, int left, int top, int width, int height) {
   VipsImage *tmp = NULL;
 
@@ -133,7 +201,7 @@ int flatten_image(VipsImage *in, VipsImage **out, double r, double g, double b)
     double background[3] = {r, g, b};
     VipsArrayDouble *vipsBackground = vips_array_double_new(background, 3);
 
-    int code = vips_flatten(in, out, "background", vipsBackground);
+    int code = vips_flatten(in, out, "background", vipsBackground, NULL);
 
     vips_area_unref(VIPS_AREA(vipsBackground));
     return code;
@@ -146,27 +214,131 @@ int composite_image(VipsImage *base, VipsImage *overlay, VipsImage **out) {
 }
 
 
-// TODO: maybe use struct for params?
-int label(VipsImage *in, VipsImage **out, const char *text, const char *font, const char *font_file, double r, double g, double b, int x, int y, int width, int height) {
-    double black[3] = {0, 0, 0};
+// text_mask renders text into one band mask. With height set, font size is picked to fit the box, otherwise
+// it's set by dpi
+int text_mask(VipsImage **out, const char *text, const char *font, const char *font_file, int width, int height, int dpi, int align) {
+    if (height > 0)
+        return vips_text(out, text, "font", font, "fontfile", font_file, "width", width, "height", height,
+            "align", align, NULL);
+
+    return vips_text(out, text, "font", font, "fontfile", font_file, "width", width, "dpi", dpi,
+        "align", align, NULL);
+}
+
+// draw_mask paints mask at x, y with given color over its shadow. Zero shadow opacity means no shadow
+int draw_mask(VipsImage *in, VipsImage *mask, VipsImage **out, double r, double g, double b, int x, int y,
+    double shadow_r, double shadow_g, double shadow_b, double shadow_opacity, double shadow_blur) {
     double color[3] = { r, g, b };
+    double shadow_color[3] = { shadow_r, shadow_g, shadow_b };
     VipsObject *base = (VipsObject *) vips_image_new();
     VipsImage **t = (VipsImage **) vips_object_local_array( VIPS_OBJECT( base ), 12 );
+    VipsImage *bg = in;
+    VipsImage *shadow;
+
+    if (vips_embed(mask, &t[0], x, y, in->Xsize, in->Ysize, NULL) || // text mask
+        NULL == (t[1] = vips_image_new_from_image(in, color, 3)) || // constant image with text color
+        vips_bandjoin2(t[1], t[0], &t[2], NULL)) { // mask as alpha
+        g_object_unref(base);
+        return 1;
+    }
 
-    int result = vips_text(&t[0], text, "font", font, "fontfile", font_file, "width", width, "height", height, NULL) ||
-         vips_embed(t[0], &t[1], x, y, in->Xsize, in->Ysize, NULL) || // text mask
-         NULL == (t[2] = vips_image_new_from_image(in, color, 3)) || // constant image with text color
-         NULL == (t[3] = vips_image_new_from_image(in, black, 3)) || // .. with shadow color
-         vips_bandjoin2(t[2], t[1], &t[4], NULL) || // text mask as alpha
-         vips_bandjoin2(t[3], t[1], &t[5], NULL) ||
-         vips_gaussblur(t[5], &t[6], 4, NULL) ||
-         vips_composite2(in, t[6], &t[7], VIPS_BLEND_MODE_OVER, "compositing_space", in->Type, NULL) ||
-         vips_composite2(t[7], t[4], out, VIPS_BLEND_MODE_OVER, "compositing_space", in->Type, NULL);
+    if (shadow_opacity > 0) {
+        if (vips_linear1(t[0], &t[3], shadow_opacity, 0, "uchar", TRUE, NULL) ||
+            NULL == (t[4] = vips_image_new_from_image(in, shadow_color, 3)) ||
+            vips_bandjoin2(t[4], t[3], &t[5], NULL)) {
+            g_object_unref(base);
+            return 1;
+        }
+        shadow = t[5];
+        if (shadow_blur > 0) {
+            if (vips_gaussblur(t[5], &t[6], shadow_blur, NULL)) {
+                g_object_unref(base);
+                return 1;
+            }
+            shadow = t[6];
+        }
+        if (vips_composite2(in, shadow, &t[7], VIPS_BLEND_MODE_OVER, "compositing_space", in->Type, NULL)) {
+            g_object_unref(base);
+            return 1;
+        }
+        bg = t[7];
+    }
+
+    int result = vips_composite2(bg, t[2], out, VIPS_BLEND_MODE_OVER, "compositing_space", in->Type, NULL);
+
+    g_object_unref(base);
+    return result;
+}
+
+// overlay covers image with color, which opacity changes linearly from top to bottom
+int overlay(VipsImage *in, VipsImage **out, double r, double g, double b, double top, double bottom) {
+    double color[3] = { r, g, b };
+    double step = in->Ysize > 1 ? (bottom - top) * 255 / (in->Ysize - 1) : 0;
+    VipsObject *base = (VipsObject *) vips_image_new();
+    VipsImage **t = (VipsImage **) vips_object_local_array( VIPS_OBJECT( base ), 6 );
+
+    int result = vips_xyz(in->Xsize, in->Ysize, &t[0], NULL) ||
+         vips_extract_band(t[0], &t[1], 1, NULL) || // y coordinates
+         vips_linear1(t[1], &t[2], step, top * 255, "uchar", TRUE, NULL) ||
+         NULL == (t[3] = vips_image_new_from_image(in, color, 3)) ||
+         vips_bandjoin2(t[3], t[2], &t[4], NULL) ||
+         vips_composite2(in, t[4], out, VIPS_BLEND_MODE_OVER, "compositing_space", in->Type, NULL);
+
+    g_object_unref(base);
+    return result;
+}
+
+// gradient makes sRGB image with colors going from one to another: along the angle (in radians) for linear
+// gradient, or from the center to the corners for radial one. The same colors give plain fill
+int gradient(VipsImage **out, int width, int height, double r1, double g1, double b1, double r2, double g2, double b2,
+    int radial, double angle) {
+    double from[3] = { r1, g1, b1 };
+    double diff[3] = { r2 - r1, g2 - g1, b2 - b1 };
+    double cx = (width - 1) / 2.0, cy = (height - 1) / 2.0;
+    VipsObject *base = (VipsObject *) vips_image_new();
+    VipsImage **t = (VipsImage **) vips_object_local_array( VIPS_OBJECT( base ), 10 );
+    int result;
+
+    if (radial) {
+        double shift[2] = { -cx, -cy };
+        double ones[2] = { 1, 1 };
+        double max_dist = sqrt(cx * cx + cy * cy);
+
+        result = vips_xyz(width, height, &t[0], NULL) ||
+            vips_linear(t[0], &t[1], ones, shift, 2, NULL) || // coordinates relative to the center
+            vips_multiply(t[1], t[1], &t[2], NULL) ||
+            NULL == (t[3] = vips_image_new_matrixv(2, 1, 1.0, 1.0)) ||
+            vips_recomb(t[2], &t[4], t[3], NULL) || // squared distance
+            vips_pow_const1(t[4], &t[5], 0.5, NULL) ||
+            vips_linear1(t[5], &t[6], max_dist > 0 ? 1 / max_dist : 0, 0, NULL); // 0 in the center, 1 in corners
+    } else {
+        double c = cos(angle), s = sin(angle);
+        // projections of the corners on the gradient direction give its start and end
+        double p[4] = { 0, (width - 1) * c, (height - 1) * s, (width - 1) * c + (height - 1) * s };
+        double lo = p[0], hi = p[0];
+        for (int i = 1; i < 4; i++) {
+            if (p[i] < lo) lo = p[i];
+            if (p[i] > hi) hi = p[i];
+        }
+
+        result = vips_xyz(width, height, &t[0], NULL) ||
+            NULL == (t[3] = vips_image_new_matrixv(2, 1, c, s)) ||
+            vips_recomb(t[0], &t[4], t[3], NULL) ||
+            vips_linear1(t[4], &t[6], hi > lo ? 1 / (hi - lo) : 0, hi > lo ? -lo / (hi - lo) : 0, NULL);
+    }
+
+    result = result ||
+        vips_linear(t[6], &t[7], diff, from, 3, "uchar", TRUE, NULL) ||
+        vips_copy(t[7], out, "interpretation", VIPS_INTERPRETATION_sRGB, NULL);
 
     g_object_unref(base);
     return result;
 }
 
+int gaussblur(VipsImage *in, VipsImage **out, double sigma) {
+    return vips_gaussblur(in, out, sigma, NULL);
+}
+
 int linear(VipsImage *in, VipsImage **out, double multiple, double add) {
     return vips_linear1(in, out, multiple, add, NULL);
 }
@@ -202,8 +374,42 @@ int autorot(VipsImage *in, VipsImage **out) {
 	return vips_autorot(in, out, NULL);
 }
 
+int get_orientation(VipsImage *in) {
+  int orientation;
+
+  if (vips_image_get_typeof(in, VIPS_META_ORIENTATION) == 0 ||
+    vips_image_get_int(in, VIPS_META_ORIENTATION, &orientation))
+    return 1;
+
+  return orientation;
+}
+
 
 void vips_cleanup() {
     vips_error_clear();
     vips_thread_shutdown();
-}
\ No newline at end of file
+}
+
+int get_n_pages(VipsImage *in) {
+  return vips_image_get_n_pages(in);
+}
+
+const char *get_interpretation(VipsImage *in) {
+  return vips_enum_nick(VIPS_TYPE_INTERPRETATION, vips_image_get_interpretation(in));
+}
+
+int get_blob(VipsImage *in, const char *name, const void **data, size_t *len) {
+  if (vips_image_get_typeof(in, name) == 0)
+    return 1;
+  return vips_image_get_blob(in, name, data, len);
+}
+
+// vips_foreign_find_load_buffer gives class name like "VipsForeignLoadJpegBuffer", while operation nickname is
+// "jpegload_buffer"
+const char *find_loader(const void *buf, size_t len) {
+    const char *name = vips_foreign_find_load_buffer(buf, len);
+    if (!name) {
+        return NULL;
+    }
+    return vips_nickname_find(g_type_from_name(name));
+}
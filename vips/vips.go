@@ -2,10 +2,13 @@ package vips
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"runtime"
 	dbg "runtime/debug"
+	"strings"
 	"unsafe"
 )
 
@@ -60,6 +63,21 @@ const (
 
 type Color struct{ R, G, B uint8 }
 
+// Shadow is drawn under text. Opacity is from 0 (no shadow) to 1, Blur is gaussian sigma
+type Shadow struct {
+	Color   Color
+	Opacity float64
+	Blur    float64
+}
+
+type Align int
+
+const (
+	AlignLow    Align = C.VIPS_ALIGN_LOW
+	AlignCentre Align = C.VIPS_ALIGN_CENTRE
+	AlignHigh   Align = C.VIPS_ALIGN_HIGH
+)
+
 // ColorRGBA represents an RGB with alpha channel (A)
 type ColorRGBA struct {
 	R, G, B, A uint8
@@ -276,6 +294,69 @@ func (img *Image) ExportWebp(quality int) ([]byte, error) {
 	return buf, nil
 }
 
+func (img *Image) ExportPng() ([]byte, error) {
+
+	var ptr unsafe.Pointer
+	// We use unsafe.Slice, so we need to free this memory later
+	cancel := func() {
+		C.g_free_go(&ptr)
+	}
+
+	imgsize := C.size_t(0)
+
+	err := C.pngsave(img.VipsImage, &ptr, &imgsize)
+
+	if err != 0 {
+		C.g_free_go(&ptr)
+		return nil, handleVipsError()
+	}
+	buf := unsafe.Slice((*byte)(ptr), int(imgsize))
+
+	img.SetCancel(cancel)
+
+	return buf, nil
+}
+
+func (img *Image) ExportAvif(quality int) ([]byte, error) {
+
+	var ptr unsafe.Pointer
+	// We use unsafe.Slice, so we need to free this memory later
+	cancel := func() {
+		C.g_free_go(&ptr)
+	}
+
+	imgsize := C.size_t(0)
+
+	err := C.avifsave(img.VipsImage, &ptr, &imgsize, C.int(quality))
+
+	if err != 0 {
+		C.g_free_go(&ptr)
+		return nil, handleVipsError()
+	}
+	buf := unsafe.Slice((*byte)(ptr), int(imgsize))
+
+	img.SetCancel(cancel)
+
+	return buf, nil
+}
+
+// RGBPixels returns raw sRGB pixels, 3 bytes per pixel. Transparent areas are flattened on white
+func (img *Image) RGBPixels() ([]byte, error) {
+	var ptr unsafe.Pointer
+	size := C.size_t(0)
+
+	if err := C.rgb_pixels(img.VipsImage, &ptr, &size); err != 0 {
+		return nil, handleVipsError()
+	}
+	defer C.g_free_go(&ptr)
+
+	return C.GoBytes(ptr, C.int(size)), nil
+}
+
+func (img *Image) HasAlpha() bool {
+	return C.has_alpha(img.VipsImage) != 0
+}
+
 func (img *Image) LoadFromBuffer(buf []byte) error {
 	img.VipsImage = C.image_new_from_buffer(unsafe.Pointer(&buf[0]), C.size_t(len(buf)))
 
@@ -285,6 +366,33 @@ func (img *Image) LoadFromBuffer(buf []byte) error {
 	return nil
 }
 
+// LoadFromBufferRandom replaces the image with one loaded with random access. Slower and takes more memory,
+// but needed for operations reading pixels out of order, like rotation
+func (img *Image) LoadFromBufferRandom(buf []byte) error {
+	out := C.image_new_from_buffer_random(unsafe.Pointer(&buf[0]), C.size_t(len(buf)))
+
+	if out == nil {
+		return handleVipsError()
+	}
+	C.swap_and_clear(&img.VipsImage, out)
+	return nil
+}
+
+// FindLoader detects format of buf by its magic bytes, without decoding anything. Returns loader nickname without
+// suffix, like "jpeg", "png" or "heif"
+func FindLoader(buf []byte) (string, error) {
+	if len(buf) == 0 {
+		return "", errors.New("empty buffer")
+	}
+
+	name := C.find_loader(unsafe.Pointer(&buf[0]), C.size_t(len(buf)))
+	if name == nil {
+		return "", handleVipsError()
+	}
+
+	return strings.TrimSuffix(C.GoString(name), "load_buffer"), nil
+}
+
 func (img *Image) ThumbnailFromBuffer(buf []byte, width int, height int, crop Interesting, size Size) error {
 	var out *C.VipsImage
 
@@ -296,8 +404,11 @@ func (img *Image) ThumbnailFromBuffer(buf []byte, width int, height int, crop In
 	return nil
 }
 
-func (img *Image) Label(text string, font string, fontFile string, color Color, x int, y int, width int, height int) error {
-	var tmp *C.VipsImage
+// Text replaces the image with one band mask of rendered text, which is pango markup. If height is set, font size
+// is picked to fit width x height box, otherwise it's scaled by dpi (72 means font size in pixels). Align sets
+// alignment of lines relative to each other
+func (img *Image) Text(text string, font string, fontFile string, width int, height int, dpi int, align Align) error {
+	var out *C.VipsImage
 
 	cText := C.CString(text)
 	defer C.free(unsafe.Pointer(cText))
@@ -308,16 +419,74 @@ func (img *Image) Label(text string, font string, fontFile string, color Color,
 	ff := C.CString(fontFile)
 	defer C.free(unsafe.Pointer(ff))
 
-	if err := C.label(img.VipsImage, &tmp, cText, f, ff, C.double(color.R), C.double(color.G), C.double(color.B),
-		C.int(x), C.int(y), C.int(width), C.int(height)); err != 0 {
-		return handleImageError(tmp)
+	if err := C.text_mask(&out, cText, f, ff, C.int(width), C.int(height), C.int(dpi), C.int(align)); err != 0 {
+		return handleImageError(out)
+	}
+
+	C.swap_and_clear(&img.VipsImage, out)
+
+	return nil
+}
+
+// DrawMask paints mask (e.g. made by Text) at x, y with the color, over its shadow
+func (img *Image) DrawMask(mask *Image, color Color, x int, y int, shadow Shadow) error {
+	var out *C.VipsImage
+
+	if err := C.draw_mask(img.VipsImage, mask.VipsImage, &out, C.double(color.R), C.double(color.G), C.double(color.B),
+		C.int(x), C.int(y), C.double(shadow.Color.R), C.double(shadow.Color.G), C.double(shadow.Color.B),
+		C.double(shadow.Opacity), C.double(shadow.Blur)); err != 0 {
+		return handleImageError(out)
+	}
+
+	C.swap_and_clear(&img.VipsImage, out)
+
+	return nil
+}
+
+// Overlay covers the image with the color. Opacity goes linearly from top to bottom value, both are from 0 to 1
+func (img *Image) Overlay(color Color, top float64, bottom float64) error {
+	var out *C.VipsImage
+
+	if err := C.overlay(img.VipsImage, &out, C.double(color.R), C.double(color.G), C.double(color.B),
+		C.double(top), C.double(bottom)); err != 0 {
+		return handleImageError(out)
 	}
 
-	C.swap_and_clear(&img.VipsImage, tmp)
+	C.swap_and_clear(&img.VipsImage, out)
 
 	return nil
 }
 
+// Gradient replaces the image with sRGB one filled by colors going from one to another. Linear gradient goes along
+// the angle in degrees, 0 is from left to right and 90 from top to bottom. Radial goes from the center to the
+// corners. Plain fill is gradient of the same colors
+func (img *Image) Gradient(width int, height int, from Color, to Color, radial bool, angle float64) error {
+	var out *C.VipsImage
+
+	isRadial := 0
+	if radial {
+		isRadial = 1
+	}
+
+	if err := C.gradient(&out, C.int(width), C.int(height), C.double(from.R), C.double(from.G), C.double(from.B),
+		C.double(to.R), C.double(to.G), C.double(to.B), C.int(isRadial), C.double(angle*math.Pi/180)); err != 0 {
+		return handleImageError(out)
+	}
+
+	C.swap_and_clear(&img.VipsImage, out)
+
+	return nil
+}
+
+func (img *Image) Blur(sigma float64) error {
+	var out *C.VipsImage
+	if err := C.gaussblur(img.VipsImage, &out, C.double(sigma)); err != 0 {
+		return handleImageError(out)
+	}
+	C.swap_and_clear(&img.VipsImage, out)
+	return nil
+}
+
 func (img *Image) Linear(multiply float32, add float32) error {
 	var out *C.VipsImage
 	if err := C.linear(img.VipsImage, &out, C.double(multiply), C.double(add)); err != 0 {
@@ -338,6 +507,67 @@ func (img *Image) AutoRotate() error {
 	return nil
 }
 
+// Orientation returns EXIF orientation, 1 if there is none
+func (img *Image) Orientation() int {
+	return int(C.get_orientation(img.VipsImage))
+}
+
+func (img *Image) Bands() int {
+	return int(img.VipsImage.Bands)
+}
+
+// Pages returns number of pages (or frames for animations) in the file, not only loaded ones
+func (img *Image) Pages() int {
+	return int(C.get_n_pages(img.VipsImage))
+}
+
+// Interpretation returns name of the colour space, like "srgb" or "cmyk"
+func (img *Image) Interpretation() string {
+	return C.GoString(C.get_interpretation(img.VipsImage))
+}
+
+// Fields lists names of all metadata fields
+func (img *Image) Fields() []string {
+	fields := C.vips_image_get_fields(img.VipsImage)
+	defer C.g_strfreev(fields)
+
+	var names []string
+	for p := fields; *p != nil; p = (**C.gchar)(unsafe.Add(unsafe.Pointer(p), unsafe.Sizeof(*p))) {
+		names = append(names, C.GoString((*C.char)(*p)))
+	}
+	return names
+}
+
+// GetString returns metadata field of any type converted to string
+func (img *Image) GetString(name string) (string, bool) {
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+
+	var out *C.char
+	if err := C.vips_image_get_as_string(img.VipsImage, cName, &out); err != 0 {
+		C.vips_error_clear()
+		return "", false
+	}
+	defer C.g_free(C.gpointer(out))
+
+	return C.GoString(out), true
+}
+
+// GetBlob returns copy of binary metadata field, like "icc-profile-data"
+func (img *Image) GetBlob(name string) ([]byte, bool) {
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+
+	var data unsafe.Pointer
+	size := C.size_t(0)
+	if err := C.get_blob(img.VipsImage, cName, &data, &size); err != 0 {
+		C.vips_error_clear()
+		return nil, false
+	}
+
+	return C.GoBytes(data, C.int(size)), true
+}
+
 func Cleanup() {
 	C.vips_cleanup()
 }
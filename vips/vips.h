@@ -13,6 +13,7 @@ void swap_and_clear(VipsImage **in, VipsImage *out);
 int vips_initialize();
 
 VipsImage* image_new_from_buffer(void *buf, size_t len);
+VipsImage* image_new_from_buffer_random(void *buf, size_t len);
 int vips_jpegload_go(void *buf, size_t len, VipsImage **out);
 int thumbnail_buffer(void *buf, size_t len, VipsImage **out,int width,int height, int crop, int size);
 
@@ -21,6 +22,10 @@ int resize(VipsImage *in, VipsImage **out, double ratio);
 int crop(VipsImage *in, VipsImage **out, int x, int y, int width, int height);
 int jpegsave(VipsImage *in, void **buf, size_t *len, int quality);
 int webpsave(VipsImage *in, void **buf, size_t *len, int quality);
+int pngsave(VipsImage *in, void **buf, size_t *len);
+int avifsave(VipsImage *in, void **buf, size_t *len, int quality);
+int has_alpha(VipsImage *in);
+int rgb_pixels(VipsImage *in, void **buf, size_t *len);
 
 int embed_image(VipsImage *in, VipsImage **out, int left, int top, int width, int height);
 int embed_image_background(VipsImage *in, VipsImage **out, int left, int top, int width,
@@ -30,8 +35,21 @@ int composite_image(VipsImage *base,  VipsImage *overlay, VipsImage **out);
 
 int flatten_image(VipsImage *in, VipsImage **out, double r, double g, double b);
 
-int label(VipsImage *in, VipsImage **out, const char *text, const char *font, const char *font_file, double r, double g, double b, int x, int y, int width, int height);
+int text_mask(VipsImage **out, const char *text, const char *font, const char *font_file, int width, int height, int dpi, int align);
+int draw_mask(VipsImage *in, VipsImage *mask, VipsImage **out, double r, double g, double b, int x, int y,
+    double shadow_r, double shadow_g, double shadow_b, double shadow_opacity, double shadow_blur);
+int overlay(VipsImage *in, VipsImage **out, double r, double g, double b, double top, double bottom);
+int gradient(VipsImage **out, int width, int height, double r1, double g1, double b1, double r2, double g2, double b2,
+    int radial, double angle);
+int gaussblur(VipsImage *in, VipsImage **out, double sigma);
 int linear(VipsImage *in, VipsImage **out, double multiple, double add);
 int strip(VipsImage *in, VipsImage **out);
 void vips_cleanup();
-int autorot(VipsImage *in, VipsImage **out);
\ No newline at end of file
+int autorot(VipsImage *in, VipsImage **out);
+int get_orientation(VipsImage *in);
+void image_ref(VipsImage *in);
+void image_kill(VipsImage *in);
+int get_n_pages(VipsImage *in);
+const char *get_interpretation(VipsImage *in);
+const char *find_loader(const void *buf, size_t len);
+int get_blob(VipsImage *in, const char *name, const void **data, size_t *len);
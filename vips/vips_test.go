@@ -0,0 +1,46 @@
+package vips
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	if err := Init(nil); err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	Shutdown()
+	os.Exit(code)
+}
+
+func TestFindLoader(t *testing.T) {
+	var tests = []struct {
+		file string
+		want string
+	}{
+		{"header.jpg", "jpeg"},
+		{"pixel.png", "png"},
+		{"header.webp", "webp"},
+		{"two-frames.gif", "gif"},
+	}
+
+	for _, tt := range tests {
+		data, err := os.ReadFile("../testdata/" + tt.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := FindLoader(data)
+		if err != nil {
+			t.Errorf("%s: %v", tt.file, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.file, got, tt.want)
+		}
+	}
+
+	if _, err := FindLoader([]byte("not an image at all")); err == nil {
+		t.Error("no error for unknown format")
+	}
+}